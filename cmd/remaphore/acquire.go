@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/nats"
+)
+
+// remaphore [-c configfile] [-p pubkey] [-t duration] acquire name [-n permits] [-ttl duration] -- cmd...
+
+// runAcquire runs a command while holding a lease of a distributed semaphore and returns its exit code.
+func runAcquire(request *nats.Request, args []string) int {
+	var permits = 1
+	var ttl = time.Minute
+	if len(args) < 1 {
+		util.ExitError(2, "acquire requires a semaphore name")
+	}
+	name := args[0]
+	fs := flag.NewFlagSet("acquire", flag.ExitOnError)
+	fs.IntVar(&permits, "n", permits, "Number of permits of the semaphore")
+	fs.DurationVar(&ttl, "ttl", ttl, "Lease expires if not refreshed within duration")
+	_ = fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		util.ExitError(2, "acquire requires a command to run")
+	}
+	if permits < 1 || ttl < nats.MinSemaphoreTTL {
+		util.ExitError(2, "-n must be positive and -ttl at least %s", nats.MinSemaphoreTTL)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		// The connection stays open, the lease is released when the command ended.
+		<-sigChan
+		cancel()
+		request.Cancel()
+	}()
+	lease, err := request.Acquire(name, permits, ttl)
+	if err == nats.ErrSemaphoreTimeout {
+		if ctx.Err() != nil {
+			return 130
+		}
+		util.StdErr("ERROR: %s\n", err)
+		return 1
+	}
+	if err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	defer func() {
+		if err := lease.Release(); err != nil {
+			util.StdErr("Release: %s\n", err)
+		}
+	}()
+	go func() {
+		select {
+		case <-lease.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	cmd := exec.CommandContext(ctx, fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			util.StdErr("ERROR: %s\n", err)
+			return 3
+		}
+	}
+	return cmd.ProcessState.ExitCode()
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aurora-is-near/remaphore/src/nats"
+)
+
+// cancelOnSignal cancels the request on the receivers on SIGINT or SIGTERM. A
+// second signal exits immediately.
+func cancelOnSignal(request *nats.Request) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	request.Cancel()
+	<-sigChan
+	os.Exit(130)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/nats"
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// remaphore [-c configfile] [-p pubkey] [-v verb] [-D dst] [-L selector] [-e] [-valid duration] cosign -init [-in duration] file message...
+// remaphore [-c configfile] [-p pubkey] cosign file
+// remaphore [-c configfile] [-S subject] [-js] cosign -send file
+
+// runCosign creates, signs or sends a message that needs the signatures of several
+// peers and returns the exit code.
+func runCosign(request *nats.Request, args []string) int {
+	var create, send bool
+	var in = 15 * time.Minute
+	fs := flag.NewFlagSet("cosign", flag.ExitOnError)
+	fs.BoolVar(&create, "init", create, "Create the message to sign, signed by the local identity")
+	fs.DurationVar(&in, "in", in, "Send time of the created message from now")
+	fs.BoolVar(&send, "send", send, "Send the signed message at its send time")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		util.ExitError(2, "cosign requires a message file")
+	}
+	if create && send {
+		util.ExitError(2, "-init and -send are mutually exclusive")
+	}
+	if len(request.Agent) > 0 && !send {
+		util.ExitError(2, "cosign requires a config file")
+	}
+	file := fs.Arg(0)
+	if create {
+		if len(clVerbParsed) != 1 {
+			util.ExitError(2, "cosign -init requires one verb")
+		}
+		if request.Encrypt && request.Config.Quorums.Signers(clVerbParsed[0]) > 1 {
+			// Approvers must be able to read what they sign.
+			util.ExitError(2, "cosign -init cannot encrypt verbs that need several signatures")
+		}
+		dest := clMatchDest
+		if dest == "" {
+			dest = "**"
+		}
+		msg := &protocol.Message{
+			SenderPublicKey: request.SenderPublicKey,
+			Destination:     dest,
+			Selector:        request.Selector,
+			UUID:            []byte(clUUID),
+			Verb:            clVerbParsed[0],
+			Payload:         strings.Join(fs.Args()[1:], " "),
+			Encrypted:       request.Encrypt,
+			Validity:        clValidity,
+		}
+		d, err := msg.EncodeMessageAt(request.Config, time.Now().Add(in))
+		if err != nil {
+			util.ExitError(3, "ERROR: %s", err)
+		}
+		return writeCosign(request.Config, file, msg, d)
+	}
+	if send {
+		if err := runPublish(request, file); err != nil {
+			util.ExitError(3, "ERROR: %s", err)
+		}
+		return 0
+	}
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	msg, err := protocol.ParseSigned(d)
+	if err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	printCosign(request.Config, msg)
+	if d, err = msg.Cosign(request.Config, request.SenderPublicKey); err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	return writeCosign(request.Config, file, msg, d)
+}
+
+func writeCosign(config *protocol.Config, file string, msg *protocol.Message, d []byte) int {
+	if err := ioutil.WriteFile(file, d, 0600); err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	util.StdErr("Signers: %d of %d required\n", len(msg.Signers()), config.Quorums.Signers(msg.Verb))
+	return 0
+}
+
+// printCosign prints what a message to sign does, so that signers know what they approve.
+func printCosign(config *protocol.Config, msg *protocol.Message) {
+	payload := msg.Payload
+	if msg.Encrypted {
+		payload = "(encrypted)"
+	}
+	util.StdErr("Verb: %s\nDestination: %s\n", msg.Verb, msg.Destination)
+	if len(msg.Selector) > 0 {
+		util.StdErr("Selector: %s\n", msg.Selector)
+	}
+	util.StdErr("Send time: %s\nValid until: %s\nPayload: %s\n", time.Unix(0, msg.SendTimeNano).Format(time.RFC3339),
+		msg.ValidUntil(config).Format(time.RFC3339), payload)
+	for _, k := range msg.Signers() {
+		name := config.Peers.Destination(k)
+		if name == "" {
+			name = "unknown"
+		}
+		util.StdErr("Signed by: %s (%s)\n", base58.Encode(k), name)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// remaphore [-c configfile] [-D dst] -explain verb
+// remaphore [-c configfile] -effective
+
+// runExplain prints how the permissions of the local identities and of the peers
+// decide about verb sent to dest now. Permissions scoped to destinations only apply if
+// dest is given. It returns true if any of them allows the verb.
+func runExplain(config *protocol.Config, verb, dest string) bool {
+	var allowed bool
+	print := func(kind, name string, trace *protocol.PermissionTrace) {
+		allowed = allowed || trace.Allowed
+		lines := strings.Split(trace.String(), "\n")
+		util.StdOut("%s %s %s\n", kind, name, lines[0])
+		for _, l := range lines[1:] {
+			util.StdOut("%s\n", l)
+		}
+	}
+	now := time.Now()
+	for _, i := range config.Identities {
+		print("identity", base58.Encode(i.PublicKey), config.TracePermission(i.Permissions, verb, dest, now))
+	}
+	for _, p := range config.Peers {
+		print("peer", p.Destination, config.TracePermission(p.Permissions, verb, dest, now))
+	}
+	return allowed
+}
+
+// runEffective prints the permissions of the local identities and of the peers that
+// are in effect now. Entries restricted to time windows are left out outside of them.
+func runEffective(config *protocol.Config) {
+	now := time.Now()
+	for _, i := range config.Identities {
+		util.StdOut("identity %s [%s]\n", base58.Encode(i.PublicKey), strings.Join(config.EffectivePermissions(i.Permissions, now), ", "))
+	}
+	for _, p := range config.Peers {
+		util.StdOut("peer %s [%s]\n", p.Destination, strings.Join(config.EffectivePermissions(p.Permissions, now), ", "))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/nats"
+)
+
+// remaphore [-c configfile] [-F format] -ls [pattern]
+
+// nodeJSON is a node in the json output format.
+type nodeJSON struct {
+	Destination string    `json:"destination"`
+	PublicKey   string    `json:"public_key"`
+	Online      bool      `json:"online"`
+	LastSeen    time.Time `json:"last_seen,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	Started     time.Time `json:"started,omitempty"`
+	ConfigHash  string    `json:"config_hash,omitempty"`
+	Verbs       []string  `json:"verbs,omitempty"`
+}
+
+// runList prints the configured peers matching pattern with their presence. It
+// returns true if any of them is online.
+func runList(request *nats.Request, pattern string) (online bool, err error) {
+	nodes, err := request.Nodes(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, node := range nodes {
+		online = online || node.Online
+	}
+	if clFormat == formatJSON {
+		for _, node := range nodes {
+			n := nodeJSON{
+				Destination: node.Peer.Destination,
+				PublicKey:   base58.Encode(node.Peer.PublicKey),
+				Online:      node.Online,
+				LastSeen:    node.LastSeen,
+			}
+			if node.Presence != nil {
+				n.Version = node.Presence.Version
+				n.Started = node.Presence.Started
+				n.ConfigHash = node.Presence.ConfigHash
+				n.Verbs = node.Presence.Verbs
+			}
+			d, _ := json.Marshal(&n)
+			util.StdOut("%s\n", d)
+		}
+		return online, nil
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "DESTINATION\tSTATUS\tLAST-SEEN\tVERSION\tUPTIME\tCONFIG\tVERBS")
+	for _, node := range nodes {
+		status, lastSeen, version, uptime, hash, verbs := "offline", "never", "-", "-", "-", "-"
+		if node.Online {
+			status = "online"
+		}
+		if p := node.Presence; p != nil {
+			lastSeen = time.Since(node.LastSeen).Round(time.Second).String() + " ago"
+			version, hash = p.Version, p.ConfigHash
+			if node.Online {
+				uptime = node.LastSeen.Sub(p.Started).Round(time.Second).String()
+			}
+			if len(p.Verbs) > 0 {
+				verbs = strings.Join(p.Verbs, ",")
+			}
+		}
+		_, _ = fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", node.Peer.Destination, status, lastSeen, version, uptime, hash, verbs)
+	}
+	return online, table.Flush()
+}
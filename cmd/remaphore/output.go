@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+const (
+	formatText  = "text"
+	formatCSV   = "csv"
+	formatJSON  = "json"
+	formatTable = "table"
+)
+
+// replyPrinter writes replies to stdout in one of the output formats.
+type replyPrinter struct {
+	format string
+	sep    string
+	csv    *csv.Writer
+	table  *tabwriter.Writer
+	follow bool                  // Print streamed output as it arrives.
+	lines  map[string]*[2]string // Incomplete last lines of stdout and stderr per destination.
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case formatText, formatCSV, formatJSON, formatTable:
+		return true
+	}
+	return false
+}
+
+// validFollowFormat returns true if output can be streamed in format.
+func validFollowFormat(format string) bool {
+	return format == formatText || format == formatJSON
+}
+
+func newReplyPrinter(format string, follow bool) *replyPrinter {
+	p := &replyPrinter{
+		format: format,
+		sep:    hex.EncodeToString(protocol.RandomBytes(16)),
+		follow: follow,
+		lines:  make(map[string]*[2]string),
+	}
+	switch format {
+	case formatCSV:
+		p.csv = csv.NewWriter(os.Stdout)
+		_ = p.csv.Write([]string{"destination", "exit_code", "start", "end", "truncated", "stdout", "stderr", "status"})
+	case formatTable:
+		p.table = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		_, _ = fmt.Fprintln(p.table, "DESTINATION\tEXIT\tDURATION\tOUTPUT")
+	}
+	return p
+}
+
+// output returns the trimmed output, or the status if the command was not executed.
+func output(reply *protocol.Reply) string {
+	out := strings.TrimFunc(reply.Output(), unicode.IsSpace)
+	if len(out) == 0 && len(reply.Status) > 0 {
+		return "(" + reply.Status + ")"
+	}
+	return out
+}
+
+// summary returns the first line of the output, marking omitted content.
+func summary(reply *protocol.Reply) string {
+	out := output(reply)
+	if p := strings.Index(out, "\n"); p >= 0 {
+		return out[:p] + " ..."
+	}
+	if reply.Truncated {
+		return out + " ..."
+	}
+	return out
+}
+
+// printLines prints the complete lines of s prefixed by destination and keeps the rest in *rest.
+func printLines(f *os.File, destination string, rest *string, s string) {
+	s = *rest + s
+	for {
+		i := strings.Index(s, "\n")
+		if i < 0 {
+			break
+		}
+		_, _ = fmt.Fprintf(f, "%s: %s\n", destination, s[:i])
+		s = s[i+1:]
+	}
+	*rest = s
+}
+
+// printFollow prints streamed output line by line, and the exit status with the final reply.
+func (p *replyPrinter) printFollow(destination string, reply *protocol.Reply) {
+	lines, ok := p.lines[destination]
+	if !ok {
+		lines = new([2]string)
+		p.lines[destination] = lines
+	}
+	printLines(os.Stdout, destination, &lines[0], reply.Stdout)
+	printLines(os.Stderr, destination, &lines[1], reply.Stderr)
+	if reply.Partial {
+		return
+	}
+	if len(lines[0]) > 0 {
+		printLines(os.Stdout, destination, &lines[0], "\n")
+	}
+	if len(lines[1]) > 0 {
+		printLines(os.Stderr, destination, &lines[1], "\n")
+	}
+	delete(p.lines, destination)
+	status := fmt.Sprintf("exit %d", reply.ExitCode)
+	if len(reply.Status) > 0 {
+		status += " (" + reply.Status + ")"
+	}
+	if reply.Truncated {
+		status += ", output truncated"
+	}
+	util.StdOut("%s: %s after %v\n", destination, status, reply.Duration().Round(time.Millisecond))
+}
+
+func (p *replyPrinter) Print(destination string, reply *protocol.Reply) {
+	if p.follow && p.format == formatText {
+		p.printFollow(destination, reply)
+		return
+	}
+	switch p.format {
+	case formatCSV:
+		_ = p.csv.Write([]string{
+			destination,
+			strconv.Itoa(reply.ExitCode),
+			reply.Start.Format(time.RFC3339Nano),
+			reply.End.Format(time.RFC3339Nano),
+			strconv.FormatBool(reply.Truncated),
+			reply.Stdout,
+			reply.Stderr,
+			reply.Status,
+		})
+		p.csv.Flush()
+	case formatJSON:
+		r := *reply
+		r.Destination = destination
+		d, _ := json.Marshal(&r)
+		util.StdOut("%s\n", d)
+	case formatTable:
+		_, _ = fmt.Fprintf(p.table, "%s\t%d\t%v\t%s\n", destination, reply.ExitCode, reply.Duration().Round(time.Millisecond), summary(reply))
+	default:
+		payload := output(reply)
+		if strings.Contains(payload, "\n") {
+			util.StdOut("--> %s\n%s,%d,%s\n--< %s\n", p.sep, destination, reply.ExitCode, payload, p.sep)
+		} else {
+			util.StdOut("%s,%d,%s\n", destination, reply.ExitCode, payload)
+		}
+	}
+}
+
+func (p *replyPrinter) Close() {
+	if p.table != nil {
+		_ = p.table.Flush()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/nats"
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// remaphore [-c configfile] -s -sign-only [-at time] [-valid duration] [-m verb] [-u uuid] [-p pubkey] [-D dst] [-L selector] -o file message....
+// remaphore [-c configfile] [-S subject] [-js] -publish file
+
+// runSignOnly writes the signed message to file instead of sending it. It does not
+// connect to NATS.
+func runSignOnly(request *nats.Request, file, dest, verb, payload string) error {
+	if dest == "" {
+		dest = "**"
+	}
+	at := clSendAtParsed
+	if at.IsZero() {
+		at = time.Now()
+	}
+	var uuid []byte
+	if len(clUUID) > 0 {
+		uuid = []byte(clUUID)
+	}
+	msg := &protocol.Message{
+		SenderPublicKey: request.SenderPublicKey,
+		Destination:     dest,
+		Selector:        request.Selector,
+		UUID:            uuid,
+		Verb:            verb,
+		Payload:         payload,
+		Encrypted:       request.Encrypt,
+		Validity:        clValidity,
+	}
+	d, err := msg.EncodeMessageAt(request.Config, at)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, d, 0600); err != nil {
+		return err
+	}
+	util.StdErr("Valid from %s until %s\n", at.Format(time.RFC3339), msg.ValidUntil(request.Config).Format(time.RFC3339))
+	return nil
+}
+
+// runPublish sends the signed message in file unchanged. It waits for the send time of
+// the message and fails if the message is no longer valid.
+func runPublish(request *nats.Request, file string) error {
+	d, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	msg, err := protocol.ParseSigned(d)
+	if err != nil {
+		return err
+	}
+	if until := msg.ValidUntil(request.Config); time.Now().After(until) {
+		return fmt.Errorf("message expired at %s", until.Format(time.RFC3339))
+	}
+	at := time.Unix(0, msg.SendTimeNano)
+	if wait := time.Until(at); wait > 0 {
+		util.StdErr("Sending at %s\n", at.Format(time.RFC3339))
+		time.Sleep(wait)
+	}
+	return request.Publish(d)
+}
@@ -3,26 +3,33 @@ package main
 import (
 	"context"
 	"crypto/ed25519"
-	"encoding/hex"
 	"flag"
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
-	"unicode"
 
 	"github.com/btcsuite/btcutil/base58"
 
-	"github.com/aurora-is-near/remaphore/src/subprocess"
-
 	"github.com/aurora-is-near/remaphore/src/protocol"
 
 	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
 	"github.com/aurora-is-near/remaphore/src/nats"
+	"github.com/aurora-is-near/remaphore/src/subprocess"
 )
 
-// remaphore [-c configfile] [-S subject] [-m verb,...] [-o] [-u uuid] [-t duration] [-d] [-D dst] [parse.sh]
-// remaphore [-c configfile] [-r|-s] [-S subject] [-m verb] [-u uuid] [-p pubkey] [-D dst] message....
+// remaphore [-c configfile] [-S subject] [-m verb,...] [-o] [-u uuid] [-t duration] [-d] [-D dst] [-delivery mode] [-exec-timeout duration] [-output-limit bytes] [-presence interval] [parse.sh]
+// remaphore [-c configfile] [-r [-follow] [-online]|-s [-ack-timeout duration]] [-S subject] [-m verb] [-u uuid] [-p pubkey] [-D dst] [-L selector] message....
+// remaphore [-c configfile] -s -sign-only [-at time] [-valid duration] [-m verb] [-u uuid] [-p pubkey] [-D dst] [-L selector] -o file message....
+// remaphore [-c configfile] [-S subject] -publish file
+// remaphore [-c configfile] -serve [-S subject] [-t duration] [-presence interval]
+// remaphore [-c configfile] [-F format] [-L selector] -ls [pattern]
+// remaphore [-c configfile] [-D dst] -explain verb
+// remaphore [-c configfile] -effective
+// remaphore [-c configfile] -b name [-n count | -D dst] [-v verb] [-t duration]
+// remaphore [-c configfile] [-p pubkey] [-t duration] acquire name [-n permits] [-ttl duration] -- cmd...
+// remaphore [-c configfile] [-p pubkey] [-v verb] [-D dst] cosign [-init [-in duration] | -send] file [message...]
 
 var (
 	clConfigFile    = "/etc/remaphore/remaphore.conf"
@@ -39,16 +46,56 @@ var (
 	clPubkeyParsed  []byte
 	clNoFilterDest  bool
 	clMatchDest     string
+	clSelector      string
+	clSelectorParse protocol.Selector
 	clRemainder     []string
 	clMessage       string
+	clReplayStore   string
+	clJetStream     bool
+	clSince         time.Duration
+	clStartSeq      uint64
+	clDurable       string
+	clBarrier       string
+	clBarrierCount  int
+	clEncrypt       bool
+	clFormat        = formatText
+	clRequireAll    bool
+	clFailOnNonzero bool
+	clAgent         string
+	clServe         bool
+	clDelivery      = protocol.DeliveryArgv
+	clExecTimeout   time.Duration
+	clOutputLimit   = protocol.DefaultOutputLimit
+	clFollow        bool
+	clCancelTimeout bool
+	clAckTimeout    time.Duration
+	clPresence      time.Duration
+	clList          bool
+	clOnlineOnly    bool
+	clExplain       string
+	clEffective     bool
+	clSignOnly      bool
+	clSignOut       string
+	clSendAt        string
+	clSendAtParsed  time.Time
+	clValidity      time.Duration
+	clPublish       string
+)
+
+// Exit codes of request&response mode.
+const (
+	exitNoneReceived = 1
+	exitSomeFailed   = 4
+	exitSomeMissing  = 5
 )
 
 func init() {
 	flag.BoolVar(&clGenConfigFile, "C", clGenConfigFile, "Print example config file")
 	flag.StringVar(&clConfigFile, "c", clConfigFile, "Path to config file")
+	flag.StringVar(&clAgent, "A", clAgent, "Use agent listening on socket instead of config file")
 	flag.StringVar(&clSubject, "S", clSubject, "Subject to communicate on")
 	flag.StringVar(&clVerb, "v", clVerb, "-v <verb>[,verb...]: Verb to send or match filter for")
-	flag.BoolVar(&clOnce, "o", clOnce, "Exit after one matching message received")
+	flag.BoolVar(&clOnce, "o", clOnce, "Exit after one matching message received. With -sign-only: write to the file given as first argument")
 	flag.StringVar(&clUUID, "u", clUUID, "UUID to send/filter for")
 	flag.DurationVar(&clTimeout, "t", clTimeout, "Timeout for operation")
 	flag.BoolVar(&clRequestReply, "r", clRequestReply, "Request reply to message")
@@ -56,6 +103,34 @@ func init() {
 	flag.StringVar(&clPubkey, "p", clPubkey, "Use public key for sending or match for it")
 	flag.BoolVar(&clNoFilterDest, "d", clNoFilterDest, "Do not match for destination")
 	flag.StringVar(&clMatchDest, "D", clMatchDest, "Specify destination to match")
+	flag.StringVar(&clSelector, "L", clSelector, "-L <label>=<value>[,<label>!=<value>...]: Send only to nodes with matching labels")
+	flag.StringVar(&clReplayStore, "replay-store", clReplayStore, "File to remember received messages in for replay protection")
+	flag.StringVar(&clFormat, "F", clFormat, "Output format of replies: text, csv, json or table")
+	flag.BoolVar(&clFollow, "follow", clFollow, "Print output of commands while they run")
+	flag.DurationVar(&clAckTimeout, "ack-timeout", clAckTimeout, "Wait for receivers to acknowledge delivery of sent message")
+	flag.BoolVar(&clCancelTimeout, "cancel-on-timeout", clCancelTimeout, "Cancel commands still running at the timeout")
+	flag.BoolVar(&clRequireAll, "require-all", clRequireAll, "Exit 5 unless all potential receivers replied")
+	flag.BoolVar(&clFailOnNonzero, "fail-on-nonzero", clFailOnNonzero, "Exit 4 if any reply has a non-zero exit code")
+	flag.BoolVar(&clEncrypt, "e", clEncrypt, "Encrypt payload to the receivers")
+	flag.StringVar(&clDelivery, "delivery", clDelivery, "Pass message to command as: argv, stdin or file")
+	flag.DurationVar(&clExecTimeout, "exec-timeout", clExecTimeout, "Kill command after duration")
+	flag.IntVar(&clOutputLimit, "output-limit", clOutputLimit, "Maximum bytes of command output to capture")
+	flag.DurationVar(&clPresence, "presence", clPresence, "Publish presence heartbeats at interval while receiving")
+	flag.BoolVar(&clList, "ls", clList, "List configured peers matching pattern with their presence")
+	flag.BoolVar(&clOnlineOnly, "online", clOnlineOnly, "Only wait for replies of peers that are online")
+	flag.StringVar(&clExplain, "explain", clExplain, "Show how permissions of identities and peers decide about verb sent to -D")
+	flag.BoolVar(&clEffective, "effective", clEffective, "Show the permissions of identities and peers in effect now")
+	flag.BoolVar(&clSignOnly, "sign-only", clSignOnly, "With -s -o file: write the signed message to file instead of sending it")
+	flag.StringVar(&clSendAt, "at", clSendAt, "With -sign-only: RFC3339 send time of the message")
+	flag.DurationVar(&clValidity, "valid", clValidity, "With -sign-only or cosign -init: accept the message for duration after its send time")
+	flag.StringVar(&clPublish, "publish", clPublish, "Send the signed message in file unchanged")
+	flag.BoolVar(&clServe, "serve", clServe, "Execute the handlers of the config file for incoming messages")
+	flag.StringVar(&clBarrier, "b", clBarrier, "Wait at barrier until all expected peers have arrived")
+	flag.IntVar(&clBarrierCount, "n", clBarrierCount, "Number of participants expected at barrier, including this one")
+	flag.BoolVar(&clJetStream, "js", clJetStream, "Send to and receive from the JetStream stream")
+	flag.DurationVar(&clSince, "since", clSince, "JetStream: receive messages stored within duration")
+	flag.Uint64Var(&clStartSeq, "seq", clStartSeq, "JetStream: receive messages starting at stream sequence")
+	flag.StringVar(&clDurable, "durable", clDurable, "JetStream: resume from durable consumer")
 	_ = clRemainder
 	_ = clVerbParsed
 }
@@ -81,9 +156,101 @@ func parseArgs() {
 			// util.ExitError(2, "-r and -s require a verb to send")
 		}
 	}
+	if len(clBarrier) > 0 && (clRequestReply || clSendOnly) {
+		util.ExitError(2, "-b is mutually exclusive with -r and -s")
+	}
+	if clServe && (clRequestReply || clSendOnly || len(clBarrier) > 0) {
+		util.ExitError(2, "-serve is mutually exclusive with -r, -s and -b")
+	}
+	if clList && (clRequestReply || clSendOnly || clServe || len(clBarrier) > 0) {
+		util.ExitError(2, "-ls is mutually exclusive with -r, -s, -serve and -b")
+	}
+	if clList && len(clRemainder) > 1 {
+		util.ExitError(2, "-ls takes at most one pattern")
+	}
+	if clList && clFormat != formatText && clFormat != formatJSON {
+		util.ExitError(2, "-ls supports output formats text and json")
+	}
+	if len(clExplain) > 0 && (clRequestReply || clSendOnly || clServe || clList || len(clBarrier) > 0) {
+		util.ExitError(2, "-explain is mutually exclusive with -r, -s, -serve, -ls and -b")
+	}
+	if clEffective && (clRequestReply || clSendOnly || clServe || clList || len(clBarrier) > 0 || len(clExplain) > 0) {
+		util.ExitError(2, "-effective is mutually exclusive with -r, -s, -serve, -ls, -b and -explain")
+	}
+	if len(clPublish) > 0 && (clRequestReply || clSendOnly || clServe || clList || len(clBarrier) > 0 || len(clExplain) > 0 || clEffective) {
+		util.ExitError(2, "-publish is mutually exclusive with -r, -s, -serve, -ls, -b, -explain and -effective")
+	}
+	if clSignOnly {
+		if !clSendOnly || !clOnce || len(clRemainder) == 0 {
+			util.ExitError(2, "-sign-only requires -s and -o file")
+		}
+		if clAckTimeout > 0 {
+			util.ExitError(2, "-sign-only and -ack-timeout are mutually exclusive")
+		}
+		clSignOut, clRemainder = clRemainder[0], clRemainder[1:]
+	}
+	if len(clSendAt) > 0 {
+		if !clSignOnly {
+			util.ExitError(2, "-at requires -sign-only")
+		}
+		t, err := time.Parse(time.RFC3339, clSendAt)
+		if err != nil {
+			util.ExitError(2, "ERROR: -at: %s", err)
+		}
+		clSendAtParsed = t
+	}
+	if clValidity < 0 {
+		util.ExitError(2, "-valid must not be negative")
+	}
+	if clValidity > 0 && !clSignOnly && (len(clRemainder) == 0 || clRemainder[0] != "cosign") {
+		util.ExitError(2, "-valid requires -sign-only or cosign -init")
+	}
+	if clPresence > 0 && (clRequestReply || clSendOnly || clList || len(clBarrier) > 0) {
+		util.ExitError(2, "-presence requires receive or -serve mode")
+	}
+	if clOnlineOnly && !clRequestReply {
+		util.ExitError(2, "-online requires -r")
+	}
+	if clServe && len(clAgent) > 0 {
+		util.ExitError(2, "-serve requires a config file")
+	}
+	if clBarrierCount > 0 && len(clBarrier) == 0 {
+		util.ExitError(2, "-n requires -b")
+	}
+	if !protocol.ValidDelivery(clDelivery) {
+		util.ExitError(2, "unknown delivery mode: %s", clDelivery)
+	}
+	if !validFormat(clFormat) {
+		util.ExitError(2, "unknown output format: %s", clFormat)
+	}
+	if clAckTimeout > 0 && !clSendOnly {
+		util.ExitError(2, "-ack-timeout requires -s")
+	}
+	if clCancelTimeout && !clRequestReply {
+		util.ExitError(2, "-cancel-on-timeout requires -r")
+	}
+	if clFollow && !clRequestReply {
+		util.ExitError(2, "-follow requires -r")
+	}
+	if clFollow && !validFollowFormat(clFormat) {
+		util.ExitError(2, "-follow supports output formats text and json")
+	}
+	if len(clSelector) > 0 {
+		if !clRequestReply && !clSendOnly && !clList {
+			util.ExitError(2, "-L requires -r, -s or -ls")
+		}
+		selector, err := protocol.ParseSelector(clSelector)
+		if err != nil {
+			util.ExitError(2, "ERROR: %s", err)
+		}
+		clSelectorParse = selector
+	}
 	if clNoFilterDest && len(clMatchDest) > 0 {
 		util.ExitError(2, "-d and -D are mutually exclusive")
 	}
+	if !clJetStream && (clSince > 0 || clStartSeq > 0 || len(clDurable) > 0) {
+		util.ExitError(2, "-since, -seq and -durable require -js")
+	}
 	if len(clPubkey) > 0 {
 		clPubkeyParsed = base58.Decode(clPubkey)
 		if clPubkeyParsed == nil || len(clPubkeyParsed) != ed25519.PublicKeySize {
@@ -95,40 +262,145 @@ func parseArgs() {
 func main() {
 	var received bool
 	var err error
+	subprocess.ExecHelper()
 	parseArgs()
+	if len(clAgent) == 0 && !clServe && !clSignOnly && util.UseAgent(clConfigFile, nats.DefaultAgentSocket) {
+		clAgent = nats.DefaultAgentSocket
+	}
+	if len(clAgent) > 0 && len(clReplayStore) > 0 {
+		util.ExitError(2, "-replay-store requires a config file")
+	}
+	var config *protocol.Config
+	if len(clAgent) > 0 {
+		config = util.GetAgentConfig(clAgent)
+	} else {
+		config = util.GetConfig(clConfigFile)
+	}
 	request := &nats.Request{
-		Config:          util.GetConfig(clConfigFile),
+		Config:          config,
+		Agent:           clAgent,
 		SenderPublicKey: clPubkeyParsed,
 		Subject:         clSubject,
+		Selector:        clSelectorParse,
 		Timeout:         clTimeout,
+		ReplayStore:     clReplayStore,
+		JetStream:       clJetStream,
+		Since:           clSince,
+		StartSequence:   clStartSeq,
+		Durable:         clDurable,
+		Encrypt:         clEncrypt,
+		Follow:          clFollow,
+		CancelOnTimeout: clCancelTimeout,
+		OnlineOnly:      clOnlineOnly,
+		Presence:        clPresence,
+		PresenceVerbs:   clVerbParsed,
 	}
 	switch {
+	case len(clRemainder) > 0 && clRemainder[0] == "acquire" && !clSendOnly && !clRequestReply:
+		exitCode := runAcquire(request, clRemainder[1:])
+		request.Close()
+		os.Exit(exitCode)
+	case len(clRemainder) > 0 && clRemainder[0] == "cosign" && !clSendOnly && !clRequestReply:
+		exitCode := runCosign(request, clRemainder[1:])
+		request.Close()
+		os.Exit(exitCode)
+	case len(clExplain) > 0:
+		received = runExplain(request.Config, clExplain, clMatchDest)
+	case clEffective:
+		runEffective(request.Config)
+		received = true
+	case clList:
+		var pattern string
+		if len(clRemainder) > 0 {
+			pattern = clRemainder[0]
+		}
+		received, err = runList(request, pattern)
+	case clServe:
+		received, err = runServe(request)
+	case len(clBarrier) > 0:
+		var verb string
+		if len(clVerbParsed) > 0 {
+			verb = clVerbParsed[0]
+		}
+		var arrived, missing protocol.Peers
+		arrived, missing, err = request.Barrier(clBarrier, verb, clMatchDest, clBarrierCount)
+		if err == nats.ErrBarrierTimeout {
+			err = nil
+			if clBarrierCount > 0 {
+				util.StdOut("arrived: %d of %d\n", len(arrived)+1, clBarrierCount)
+			}
+			for _, p := range missing {
+				util.StdOut("missing: %s\n", p.Destination)
+			}
+		} else {
+			received = true
+		}
+	case len(clPublish) > 0:
+		received = true
+		err = runPublish(request, clPublish)
+	case clSignOnly:
+		received = true
+		err = runSignOnly(request, clSignOut, clMatchDest, clVerbParsed[0], strings.Join(clRemainder, " "))
+	case clSendOnly && clAckTimeout > 0:
+		var missing protocol.Peers
+		dest := clMatchDest
+		if dest == "" {
+			dest = "**"
+		}
+		missing, err = request.SendAck(clAckTimeout, dest, clVerbParsed[0], strings.Join(clRemainder, " "), clUUID)
+		if err == nil {
+			for _, p := range missing {
+				util.StdErr("missing: %s\n", p.Destination)
+			}
+			received = len(missing) < len(request.PotentialReceivers(dest, clVerbParsed[0]))
+			if received && len(missing) > 0 {
+				os.Exit(exitSomeMissing)
+			}
+		}
 	case clSendOnly:
 		received = true
 		err = request.Send(clMatchDest, clVerbParsed[0], strings.Join(clRemainder, " "), clUUID)
 	case clRequestReply:
+		var failed bool
+		var missing, offline protocol.Peers
 		printChan := make(chan *protocol.Message, 10)
 		closeChan := make(chan struct{}, 1)
 		go func() {
-			sep := hex.EncodeToString(protocol.RandomBytes(16))
+			printer := newReplyPrinter(clFormat, clFollow)
 			for m := range printChan {
 				received = true
-				payload := strings.TrimFunc(m.Payload, unicode.IsSpace)
-
-				if strings.Contains(payload, "\n") {
-					util.StdOut("--> %s\n%s,%s\n--< %s\n", sep, request.Config.Peers.Destination(m.SenderPublicKey), payload, sep)
-				} else {
-					util.StdOut("%s,%s\n", request.Config.Peers.Destination(m.SenderPublicKey), payload)
-				}
+				reply := protocol.ParseReply(m.Payload)
+				failed = failed || reply.ExitCode != 0
+				printer.Print(request.Config.Peers.Destination(m.SenderPublicKey), reply)
 			}
+			printer.Close()
 			close(closeChan)
 		}()
 		handler := func(ctx context.Context, message *protocol.Message) {
 			printChan <- message
 		}
-		err = request.SendRequest(handler, clMatchDest, clVerbParsed[0], strings.Join(clRemainder, " "), clUUID)
+		go cancelOnSignal(request)
+		missing, offline, err = request.SendRequest(handler, clMatchDest, clVerbParsed[0], strings.Join(clRemainder, " "), clUUID)
 		close(printChan)
 		<-closeChan
+		if err == nats.ErrNoneOnline {
+			err = nil
+		}
+		if err == nil {
+			for _, p := range offline {
+				util.StdErr("offline: %s\n", p.Destination)
+			}
+			for _, p := range missing {
+				util.StdErr("missing: %s\n", p.Destination)
+			}
+			switch {
+			case !received:
+			case clFailOnNonzero && failed:
+				os.Exit(exitSomeFailed)
+			case clRequireAll && len(missing) > 0:
+				os.Exit(exitSomeMissing)
+			}
+		}
 	default:
 		var matches []protocol.MsgMatch
 		if len(clUUID) > 0 {
@@ -144,36 +416,33 @@ func main() {
 		if !clNoFilterDest {
 			matches = append(matches, protocol.MatchDestination(clMatchDest))
 		}
+		matches = append(matches, protocol.MatchLabels())
+		var handled int32 // Handlers may run concurrently with workers configured.
 		handler := func(ctx context.Context, message *protocol.Message, replyFunc nats.ReplyFunc) {
 			log.Println("Incoming message")
-			var out string
-			var err error
-			received = true
+			atomic.StoreInt32(&handled, 1)
 			if len(clRemainder) > 0 {
-				out, err = subprocess.Exec(ctx, request.Config, clRemainder, message)
-				if err != nil {
-					log.Printf("ERROR: %s", err)
-				}
+				execReply(ctx, request.Config, &protocol.Handler{
+					Command:     clRemainder,
+					Delivery:    clDelivery,
+					Timeout:     clExecTimeout,
+					OutputLimit: clOutputLimit,
+				}, message, replyFunc)
 			} else {
-				out = "NO_DATA"
-			}
-			if replyFunc != nil {
-				resp := new(protocol.Message)
-				resp.Payload = out
-				if err := replyFunc(resp); err != nil {
-					log.Printf("Reply error: %s\n", err)
-				}
+				now := time.Now()
+				sendReply(replyFunc, &protocol.Reply{Destination: request.Config.Destination, Start: now, End: now})
 			}
 			if clOnce {
 				request.Close()
 			}
 		}
 		err = request.Receive(handler, matches...)
+		received = atomic.LoadInt32(&handled) != 0
 	}
 	if err != nil {
 		util.ExitError(3, "ERROR: %s", err)
 	}
 	if !received {
-		os.Exit(1)
+		os.Exit(exitNoneReceived)
 	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/nats"
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/aurora-is-near/remaphore/src/subprocess"
+)
+
+// handlerTable holds the handlers of the config file. It is replaced on SIGHUP.
+type handlerTable struct {
+	mutex    sync.RWMutex
+	handlers protocol.Handlers
+}
+
+func (table *handlerTable) find(c *protocol.Config, msg *protocol.Message) *protocol.Handler {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	return table.handlers.Find(c, msg)
+}
+
+func (table *handlerTable) set(handlers protocol.Handlers) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.handlers = handlers
+}
+
+// reloadOnHangup reloads the handler table from filename whenever SIGHUP is received.
+// The subscription is not touched. If the file fails to parse, the old table is kept.
+func (table *handlerTable) reloadOnHangup(filename string) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		c, err := util.LoadConfig(filename)
+		if err != nil {
+			log.Printf("Reload failed, keeping handlers: %s", err)
+			continue
+		}
+		table.set(c.Handlers)
+		log.Printf("Reloaded %d handlers", len(c.Handlers))
+	}
+}
+
+// sendReply sends reply if one was requested.
+func sendReply(replyFunc nats.ReplyFunc, reply *protocol.Reply) {
+	if replyFunc == nil {
+		return
+	}
+	resp := new(protocol.Message)
+	resp.Payload = reply.Encode()
+	if err := replyFunc(resp); err != nil {
+		log.Printf("Reply error: %s\n", err)
+	}
+}
+
+// execReply executes handler for message and replies with the result. If the
+// requester follows the output, it is streamed in partial replies.
+func execReply(ctx context.Context, config *protocol.Config, handler *protocol.Handler, message *protocol.Message, replyFunc nats.ReplyFunc) {
+	var stream subprocess.StreamFunc
+	if message.Follow && replyFunc != nil {
+		stream = func(reply *protocol.Reply) {
+			sendReply(replyFunc, reply)
+		}
+	}
+	out, err := subprocess.ExecStream(ctx, config, handler, message, stream)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+	}
+	sendReply(replyFunc, out)
+}
+
+// runServe executes the handlers of the config file for incoming messages until
+// the timeout expires. It returns true if any message was handled.
+func runServe(request *nats.Request) (received bool, err error) {
+	var handled int32
+	table := &handlerTable{handlers: request.Config.Handlers}
+	if len(table.handlers) == 0 {
+		log.Printf("No handlers configured")
+	}
+	request.PresenceVerbs = table.handlers.Verbs()
+	go table.reloadOnHangup(clConfigFile)
+	handler := func(ctx context.Context, message *protocol.Message, replyFunc nats.ReplyFunc) {
+		h := table.find(request.Config, message)
+		if h == nil {
+			return
+		}
+		atomic.StoreInt32(&handled, 1)
+		execReply(ctx, request.Config, h, message, replyFunc)
+	}
+	// Only messages a handler matches are acknowledged.
+	match := func(c *protocol.Config, m *protocol.Message) bool {
+		return table.find(c, m) != nil
+	}
+	err = request.Receive(handler, match)
+	return atomic.LoadInt32(&handled) != 0, err
+}
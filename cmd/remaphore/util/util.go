@@ -9,6 +9,7 @@ import (
 	"unicode"
 
 	"github.com/aurora-is-near/remaphore/src/config"
+	"github.com/aurora-is-near/remaphore/src/nats"
 
 	"github.com/aurora-is-near/remaphore/src/protocol"
 )
@@ -57,14 +58,39 @@ func PrintConfig() {
 	os.Exit(0)
 }
 
-func GetConfig(filename string) *protocol.Config {
+// LoadConfig reads and parses the config file.
+func LoadConfig(filename string) (*protocol.Config, error) {
 	d, err := ioutil.ReadFile(filename)
 	if err != nil {
-		ExitError(2, "ERROR: %s", err)
+		return nil, err
 	}
-	ret, err := config.ParseConfig(d)
+	return config.ParseConfig(d)
+}
+
+func GetConfig(filename string) *protocol.Config {
+	ret, err := LoadConfig(filename)
 	if err != nil {
 		ExitError(2, "ERROR: %s", err)
 	}
 	return ret
 }
+
+// GetAgentConfig fetches the configuration from the agent listening on socket.
+func GetAgentConfig(socket string) *protocol.Config {
+	ret, err := nats.AgentConfig(socket)
+	if err != nil {
+		ExitError(2, "ERROR: agent: %s", err)
+	}
+	return ret
+}
+
+// UseAgent returns true if filename cannot be read but an agent listens on socket.
+func UseAgent(filename, socket string) bool {
+	f, err := os.Open(filename)
+	if err == nil {
+		_ = f.Close()
+		return false
+	}
+	_, err = os.Stat(socket)
+	return err == nil
+}
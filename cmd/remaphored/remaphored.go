@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/aurora-is-near/remaphore/cmd/remaphore/util"
+	"github.com/aurora-is-near/remaphore/src/agent"
+	"github.com/aurora-is-near/remaphore/src/nats"
+)
+
+// remaphored [-c configfile] [-l socket]
+
+var (
+	clConfigFile = "/etc/remaphore/remaphore.conf"
+	clSocket     = nats.DefaultAgentSocket
+)
+
+func init() {
+	flag.StringVar(&clConfigFile, "c", clConfigFile, "Path to config file")
+	flag.StringVar(&clSocket, "l", clSocket, "Path of the socket to listen on")
+}
+
+func main() {
+	flag.Parse()
+	server, err := agent.NewServer(util.GetConfig(clConfigFile))
+	if err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	defer server.Close()
+	if err := os.MkdirAll(filepath.Dir(clSocket), 0755); err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	_ = os.Remove(clSocket)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: clSocket, Net: "unix"})
+	if err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	// Every local user may connect, access is controlled by the [ Users ] section.
+	if err := os.Chmod(clSocket, 0666); err != nil {
+		util.ExitError(3, "ERROR: %s", err)
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		_ = l.Close()
+	}()
+	log.Printf("Listening on %s", clSocket)
+	if err := server.Serve(l); err != nil {
+		log.Printf("Stopped: %s", err)
+	}
+}
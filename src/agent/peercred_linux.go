@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// peerNames returns the uid and, if known, the user name of the process connected to conn.
+func peerNames(conn *net.UnixConn) ([]string, error) {
+	var cred *syscall.Ucred
+	var credErr error
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return []string{uid, u.Username}, nil
+	}
+	return []string{uid}, nil
+}
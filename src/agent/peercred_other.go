@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+// peerNames is only supported on linux.
+func peerNames(conn *net.UnixConn) ([]string, error) {
+	_ = conn
+	return nil, errors.New("peer credentials not supported on this platform")
+}
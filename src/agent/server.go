@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/aurora-is-near/remaphore/src/nats"
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+var (
+	ErrPermission = errors.New("user may not use identity or verb")
+	ErrOperation  = errors.New("unknown operation")
+)
+
+// Server executes requests of local users with the keys of its configuration
+// over one shared NATS connection.
+type Server struct {
+	config *protocol.Config
+	base   nats.Request
+}
+
+func NewServer(config *protocol.Config) (*Server, error) {
+	conn, err := nats.Connect(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		config: config,
+		base: nats.Request{
+			Config: config,
+			Conn:   conn,
+		},
+	}, nil
+}
+
+func (server *Server) Close() {
+	server.base.Conn.Close()
+}
+
+// Serve accepts connections on l until it is closed.
+func (server *Server) Serve(l *net.UnixListener) error {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go server.handle(conn)
+	}
+}
+
+// session is one client connection.
+type session struct {
+	server *Server
+	names  []string
+	conn   *net.UnixConn
+	mutex  sync.Mutex
+	enc    *json.Encoder
+	dec    *json.Decoder
+}
+
+func (s *session) respond(response *nats.AgentResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.enc.Encode(response); err != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *session) respondError(err error) {
+	if err != nil {
+		s.respond(&nats.AgentResponse{Error: err.Error()})
+		return
+	}
+	s.respond(&nats.AgentResponse{Done: true})
+}
+
+func (server *Server) handle(conn *net.UnixConn) {
+	defer func() { _ = conn.Close() }()
+	names, err := peerNames(conn)
+	if err != nil {
+		log.Printf("Peer credentials: %s", err)
+		return
+	}
+	s := &session{
+		server: server,
+		names:  names,
+		conn:   conn,
+		enc:    json.NewEncoder(conn),
+		dec:    json.NewDecoder(conn),
+	}
+	req := new(nats.AgentRequest)
+	if err := s.dec.Decode(req); err != nil {
+		return
+	}
+	log.Printf("Agent %s for user %s", req.Op, strings.Join(names, "/"))
+	switch req.Op {
+	case nats.AgentOpConfig:
+		s.respond(&nats.AgentResponse{Config: server.config.Public(names)})
+	case nats.AgentOpSend:
+		s.send(req)
+	case nats.AgentOpRequest:
+		s.respondError(s.request(req))
+	case nats.AgentOpReceive:
+		s.respondError(s.receive(req))
+	default:
+		s.respondError(ErrOperation)
+	}
+}
+
+// key returns the identity to use for verb sent to destination. If publicKey is empty,
+// the first identity the user may use is returned.
+func (s *session) key(publicKey []byte, destination string, verb ...string) ([]byte, error) {
+	config := s.server.config
+	if len(publicKey) == 0 {
+		for _, k := range config.Users.Keys(s.names, verb...) {
+			if len(verb) == 0 && config.PrivateKey(k) != nil || len(verb) > 0 && config.PrivateKeyAt(k, verb[0], destination) != nil {
+				return k, nil
+			}
+		}
+		return nil, ErrPermission
+	}
+	if !config.Users.Permitted(s.names, publicKey, verb...) {
+		return nil, ErrPermission
+	}
+	return publicKey, nil
+}
+
+func (s *session) newRequest(req *nats.AgentRequest, publicKey []byte) (*nats.Request, error) {
+	selector, err := protocol.ParseSelector(req.Selector)
+	if err != nil {
+		return nil, err
+	}
+	ret := &nats.Request{
+		Config: s.server.base.Config,
+		Conn:   s.server.base.Conn,
+	}
+	ret.SenderPublicKey = publicKey
+	ret.Subject = req.Subject
+	ret.Selector = selector
+	ret.Timeout = req.Timeout
+	ret.Encrypt = req.Encrypt
+	ret.Follow = req.Follow
+	ret.CancelOnTimeout = req.CancelOnTimeout
+	ret.OnlineOnly = req.OnlineOnly
+	ret.JetStream = req.JetStream
+	ret.Since = req.Since
+	ret.StartSequence = req.StartSequence
+	ret.Durable = req.Durable
+	return ret, nil
+}
+
+func (s *session) send(req *nats.AgentRequest) {
+	publicKey, err := s.key(req.SenderPublicKey, req.Destination, req.Verb)
+	if err != nil {
+		s.respondError(err)
+		return
+	}
+	request, err := s.newRequest(req, publicKey)
+	if err != nil {
+		s.respondError(err)
+		return
+	}
+	if req.AckTimeout <= 0 {
+		s.respondError(request.Send(req.Destination, req.Verb, req.Payload, req.UUID))
+		return
+	}
+	defer request.Close()
+	missing, err := request.SendAck(req.AckTimeout, req.Destination, req.Verb, req.Payload, req.UUID)
+	if err != nil {
+		s.respondError(err)
+		return
+	}
+	s.respond(&nats.AgentResponse{Done: true, Missing: missing})
+}
+
+func (s *session) request(req *nats.AgentRequest) error {
+	publicKey, err := s.key(req.SenderPublicKey, req.Destination, req.Verb)
+	if err != nil {
+		return err
+	}
+	request, err := s.newRequest(req, publicKey)
+	if err != nil {
+		return err
+	}
+	defer request.Close()
+	go func() {
+		// The client may cancel the request. Closing the connection ends the goroutine.
+		cancel := new(nats.AgentRequest)
+		if err := s.dec.Decode(cancel); err == nil && cancel.Op == nats.AgentOpCancel {
+			request.Cancel()
+		}
+	}()
+	handler := func(ctx context.Context, message *protocol.Message) {
+		s.respond(&nats.AgentResponse{Message: message})
+	}
+	missing, offline, err := request.SendRequest(handler, req.Destination, req.Verb, req.Payload, req.UUID)
+	if err == nats.ErrNoneOnline {
+		s.respond(&nats.AgentResponse{Error: err.Error(), Offline: offline})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.respond(&nats.AgentResponse{Done: true, Missing: missing, Offline: offline})
+	return nil
+}
+
+func (s *session) receive(req *nats.AgentRequest) error {
+	var replyMutex sync.Mutex
+	replies := make(map[string]nats.ReplyFunc)
+	acks := make(map[string]func())
+	publicKey, err := s.key(req.SenderPublicKey, "")
+	if err != nil {
+		return err
+	}
+	request, err := s.newRequest(req, publicKey)
+	if err != nil {
+		return err
+	}
+	defer request.Close()
+	request.OnAck = func(message *protocol.Message, ack func()) {
+		// Acknowledged when the client reports that the message passed its filters.
+		replyMutex.Lock()
+		acks[hex.EncodeToString(message.Hash)] = ack
+		replyMutex.Unlock()
+	}
+	go func() {
+		// Replies from the client. The connection closing ends the receive operation.
+		defer request.Close()
+		for {
+			reply := new(nats.AgentRequest)
+			if err := s.dec.Decode(reply); err != nil {
+				return
+			}
+			key := hex.EncodeToString(reply.ReplyTo)
+			if reply.Op == nats.AgentOpAck {
+				replyMutex.Lock()
+				ack, ok := acks[key]
+				delete(acks, key)
+				replyMutex.Unlock()
+				if ok {
+					ack()
+				}
+				continue
+			}
+			if reply.Op != nats.AgentOpReply {
+				continue
+			}
+			replyMutex.Lock()
+			replyFunc, ok := replies[key]
+			if reply.Reply == nil || !protocol.ParseReply(reply.Reply.Payload).Partial {
+				// Streamed output keeps the reply open until the final reply.
+				delete(replies, key)
+			}
+			delete(acks, key)
+			replyMutex.Unlock()
+			if !ok || reply.Reply == nil {
+				continue
+			}
+			reply.Reply.SenderPublicKey = publicKey
+			if err := replyFunc(reply.Reply); err != nil {
+				log.Printf("Reply error: %s", err)
+			}
+		}
+	}()
+	handler := func(ctx context.Context, message *protocol.Message, replyFunc nats.ReplyFunc) {
+		key := hex.EncodeToString(message.Hash)
+		if message = s.server.forward(s.names, message); message == nil {
+			replyMutex.Lock()
+			delete(acks, key)
+			replyMutex.Unlock()
+			return
+		}
+		if replyFunc != nil {
+			replyMutex.Lock()
+			replies[key] = replyFunc
+			replyMutex.Unlock()
+		}
+		s.respond(&nats.AgentResponse{Message: message})
+	}
+	return request.Receive(handler)
+}
+
+// forward returns the message as the user of names may receive it, or nil if the user
+// may not receive the verb. The payload of encrypted messages is only kept if they
+// have been encrypted for an identity the user may use for the verb.
+func (server *Server) forward(names []string, message *protocol.Message) *protocol.Message {
+	keys := server.config.Users.Keys(names, message.Verb)
+	if len(keys) == 0 {
+		return nil
+	}
+	if !message.Encrypted {
+		return message
+	}
+	for _, k := range keys {
+		if message.SealedFor(k) {
+			return message
+		}
+	}
+	ret := *message
+	ret.Payload = ""
+	return &ret
+}
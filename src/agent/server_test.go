@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+func TestServer_Forward(t *testing.T) {
+	sender := protocol.NewConfig()
+	sender.Identities[0].Permissions = []string{"deploy", "ping"}
+	agentConfig := protocol.NewConfig()
+	agentConfig.Identities = append(agentConfig.Identities, protocol.NewConfig().Identities[0])
+	a, b := agentConfig.Identities[0].PublicKey, agentConfig.Identities[1].PublicKey
+	agentConfig.Peers = append(agentConfig.Peers, *(sender.Identities[0].Peer(sender.Destination)))
+	agentConfig.Users = protocol.Users{
+		{Name: "alice", PublicKey: a, Permissions: []string{"deploy"}},
+		{Name: "bob", PublicKey: b, Permissions: []string{"deploy", "ping"}},
+	}
+	server := &Server{config: agentConfig}
+	for _, c := range []struct {
+		verb      string
+		encrypted bool
+		user      string
+		forwarded bool
+		payload   string
+	}{
+		{"deploy", true, "alice", true, "secret"},
+		{"deploy", true, "bob", true, ""},
+		{"deploy", false, "bob", true, "secret"},
+		{"ping", false, "alice", false, ""},
+		{"ping", true, "bob", true, ""},
+	} {
+		msg := &protocol.Message{
+			Destination: "**",
+			Verb:        c.verb,
+			Payload:     "secret",
+			Encrypted:   c.encrypted,
+			Recipients:  []protocol.Base58Bytes{a},
+		}
+		d, err := msg.EncodeMessage(sender)
+		if err != nil {
+			t.Fatalf("EncodeMessage: %s", err)
+		}
+		received, err := protocol.DecodeMessage(agentConfig, d)
+		if err != nil {
+			t.Fatalf("DecodeMessage: %s", err)
+		}
+		forwarded := server.forward([]string{c.user}, received)
+		if (forwarded != nil) != c.forwarded {
+			t.Errorf("%s encrypted %v to %s: forwarded %v", c.verb, c.encrypted, c.user, forwarded != nil)
+		} else if forwarded != nil && forwarded.Payload != c.payload {
+			t.Errorf("%s encrypted %v to %s: payload %q", c.verb, c.encrypted, c.user, forwarded.Payload)
+		}
+	}
+}
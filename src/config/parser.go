@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -24,6 +25,11 @@ const (
 	stGeneral = iota
 	stIdentity
 	stPeer
+	stUser
+	stHandler
+	stRole
+	stWindow
+	stQuorum
 )
 
 func splitValue(s string) (key, value string) {
@@ -57,6 +63,74 @@ func setGeneralValue(c *protocol.Config, key, value string) error {
 			return err
 		}
 		c.AllowedClockSkew = v
+	case "stream":
+		c.Stream = value
+	case "max_replay_age":
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.MaxReplayAge = v
+	case "max_validity":
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		c.MaxValidity = v
+	case "require_encryption":
+		for _, verb := range strings.Split(strings.ToLower(value), ",") {
+			if verb = cleanLine(verb); len(verb) > 0 {
+				c.EncryptedVerbs = append(c.EncryptedVerbs, verb)
+			}
+		}
+	case "labels":
+		labels, err := protocol.ParseLabels(value)
+		if err != nil {
+			return err
+		}
+		if c.Labels == nil {
+			c.Labels = make(protocol.Labels)
+		}
+		for k, v := range labels {
+			c.Labels[k] = v
+		}
+	case "workers":
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid workers: %s", value)
+		}
+		c.Workers = v
+	case "worker_queue":
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid worker_queue: %s", value)
+		}
+		c.WorkerQueue = v
+	case "worker_policy":
+		switch v := strings.ToLower(value); v {
+		case protocol.PolicyQueue, protocol.PolicyDrop, protocol.PolicyReject:
+			c.WorkerPolicy = v
+		default:
+			return fmt.Errorf("invalid worker_policy: %s", value)
+		}
+	case "worker_limit":
+		if c.WorkerLimits == nil {
+			c.WorkerLimits = make(map[string]int)
+		}
+		for _, l := range strings.Split(strings.ToLower(value), ",") {
+			if l = cleanLine(l); len(l) == 0 {
+				continue
+			}
+			p := strings.Index(l, "=")
+			if p <= 0 {
+				return fmt.Errorf("invalid worker_limit: %s", l)
+			}
+			v, err := strconv.Atoi(cleanLine(l[p+1:]))
+			if err != nil || v < 1 {
+				return fmt.Errorf("invalid worker_limit: %s", l)
+			}
+			c.WorkerLimits[cleanLine(l[:p])] = v
+		}
 	}
 	return nil
 }
@@ -80,6 +154,21 @@ func ParseConfig(d []byte) (*protocol.Config, error) {
 			case "peers":
 				state = stPeer
 				continue
+			case "users":
+				state = stUser
+				continue
+			case "handlers":
+				state = stHandler
+				continue
+			case "roles":
+				state = stRole
+				continue
+			case "windows":
+				state = stWindow
+				continue
+			case "quorum":
+				state = stQuorum
+				continue
 			default:
 				continue
 			}
@@ -105,8 +194,46 @@ func ParseConfig(d []byte) (*protocol.Config, error) {
 				return nil, err
 			}
 			ret.Peers = append(ret.Peers, *p)
+		case stUser:
+			u, err := parseUser(l)
+			if err != nil {
+				return nil, err
+			}
+			ret.Users = append(ret.Users, *u)
+		case stHandler:
+			h, err := parseHandler(l)
+			if err != nil {
+				return nil, err
+			}
+			ret.Handlers = append(ret.Handlers, *h)
+		case stRole:
+			if ret.Roles == nil {
+				ret.Roles = make(protocol.Roles)
+			}
+			if err := parseRole(ret.Roles, l); err != nil {
+				return nil, err
+			}
+		case stWindow:
+			if ret.Windows == nil {
+				ret.Windows = make(protocol.Windows)
+			}
+			if err := parseWindow(ret.Windows, l); err != nil {
+				return nil, err
+			}
+		case stQuorum:
+			q, err := parseQuorum(l)
+			if err != nil {
+				return nil, err
+			}
+			ret.Quorums = append(ret.Quorums, *q)
 		}
 	}
+	if err := expandRoles(ret); err != nil {
+		return nil, err
+	}
+	if err := checkWindows(ret); err != nil {
+		return nil, err
+	}
 	if err := validateConfig(ret); err != nil {
 		return nil, err
 	}
@@ -125,6 +252,58 @@ func parsePeer(s string) (*protocol.Peer, error) {
 		return nil, fmt.Errorf("bad public key: \"%s\"", f[0])
 	}
 	ret.PublicKey = pubkey
+	perms, labels := f[2], ""
+	if p := closingBracket(perms); p > 0 {
+		perms, labels = perms[:p+1], cleanLine(perms[p+1:])
+	}
+	permissions, err := parsePermissions(perms)
+	if err != nil {
+		return nil, err
+	}
+	ret.Permissions = permissions
+	if len(labels) > 0 {
+		if labels[0] != '{' || labels[len(labels)-1] != '}' {
+			return nil, fmt.Errorf("bad labels: \"%s\"", labels)
+		}
+		if ret.Labels, err = protocol.ParseLabels(labels[1 : len(labels)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// closingBracket returns the index of the bracket that closes the one s starts with,
+// skipping the brackets of ranges within it, or -1.
+func closingBracket(s string) int {
+	depth := 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+		if depth == 0 {
+			return -1
+		}
+	}
+	return -1
+}
+
+func parseUser(s string) (*protocol.User, error) {
+	ret := new(protocol.User)
+	f := strings.SplitN(s, " ", 3)
+	if len(f) != 3 {
+		return nil, fmt.Errorf("bad format: \"%s\"", s)
+	}
+	ret.Name = f[0]
+	pubkey := base58.Decode(f[1])
+	if len(pubkey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad public key: \"%s\"", f[1])
+	}
+	ret.PublicKey = pubkey
 	permissions, err := parsePermissions(f[2])
 	if err != nil {
 		return nil, err
@@ -133,6 +312,135 @@ func parsePeer(s string) (*protocol.Peer, error) {
 	return ret, nil
 }
 
+// parseSize parses a number of bytes with an optional K, M or G suffix.
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	var mult uint64 = 1
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("bad size: \"%s\"", s)
+	}
+	return v * mult, nil
+}
+
+// setHandlerOption sets an option of a handler line. It returns false if key is not an option.
+func setHandlerOption(h *protocol.Handler, key, value string) (bool, error) {
+	switch key {
+	case "dest":
+		h.Destination = value
+	case "sender":
+		h.Sender = base58.Decode(value)
+		if len(h.Sender) != ed25519.PublicKeySize {
+			return true, fmt.Errorf("bad public key: \"%s\"", value)
+		}
+	case "dir":
+		h.Dir = value
+	case "timeout":
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return true, err
+		}
+		h.Timeout = v
+	case "user":
+		h.User = value
+	case "group":
+		h.Group = value
+	case "groups":
+		h.Groups = strings.Split(value, ",")
+		for _, g := range h.Groups {
+			if g == "" {
+				return true, fmt.Errorf("bad groups: \"%s\"", value)
+			}
+		}
+	case "umask":
+		if v, err := strconv.ParseUint(value, 8, 32); err != nil || v > 0777 {
+			return true, fmt.Errorf("bad umask: \"%s\"", value)
+		}
+		h.Umask = value
+	case "rlimit_cpu":
+		v, err := time.ParseDuration(value)
+		if err != nil || v < time.Second {
+			return true, fmt.Errorf("bad rlimit_cpu: \"%s\"", value)
+		}
+		h.RlimitCPU = v
+	case "rlimit_memory":
+		v, err := parseSize(value)
+		if err != nil {
+			return true, fmt.Errorf("bad rlimit_memory: \"%s\"", value)
+		}
+		h.RlimitMemory = v
+	case "rlimit_nofile":
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || v == 0 {
+			return true, fmt.Errorf("bad rlimit_nofile: \"%s\"", value)
+		}
+		h.RlimitNofile = v
+	case "no_new_privs":
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return true, fmt.Errorf("bad no_new_privs: \"%s\"", value)
+		}
+		h.NoNewPrivs = v
+	case "delivery":
+		if !protocol.ValidDelivery(value) {
+			return true, fmt.Errorf("bad delivery: \"%s\"", value)
+		}
+		h.Delivery = value
+	case "output_limit":
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 1 {
+			return true, fmt.Errorf("bad output_limit: \"%s\"", value)
+		}
+		h.OutputLimit = v
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// parseHandler parses "verb [option=value...] command [args...]".
+func parseHandler(s string) (*protocol.Handler, error) {
+	ret := new(protocol.Handler)
+	f := strings.Fields(s)
+	if len(f) < 2 {
+		return nil, fmt.Errorf("bad format: \"%s\"", s)
+	}
+	ret.Verb = strings.ToLower(f[0])
+	f = f[1:]
+	for len(f) > 0 {
+		p := strings.Index(f[0], "=")
+		if p <= 0 {
+			break
+		}
+		ok, err := setHandlerOption(ret, f[0][:p], f[0][p+1:])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		f = f[1:]
+	}
+	if len(f) == 0 {
+		return nil, fmt.Errorf("no command: \"%s\"", s)
+	}
+	ret.Command = f
+	return ret, nil
+}
+
 func validateConfig(c *protocol.Config) error {
 	if len(c.NATSUrl) == 0 {
 		return fmt.Errorf("no nats servers configured")
@@ -152,22 +460,46 @@ func validateConfig(c *protocol.Config) error {
 	if c.Subject == "" {
 		c.Subject = "remaphore"
 	}
+	if c.Stream == "" {
+		c.Stream = "remaphore"
+	}
+	if c.MaxReplayAge == 0 {
+		c.MaxReplayAge = protocol.MaxReplayAge
+	}
+	if c.WorkerPolicy == "" {
+		c.WorkerPolicy = protocol.PolicyQueue
+	}
 	if c.DefaultKey == nil {
 		c.DefaultKey = c.Identities[0].PublicKey
 	}
+	for _, u := range c.Users {
+		if !c.IsSelf(u.PublicKey) {
+			return fmt.Errorf("user %s refers to unknown identity", u.Name)
+		}
+	}
 	return nil
 }
 
 func parsePermissions(s string) ([]string, error) {
 	if s[0] == '[' && s[len(s)-1] == ']' {
 		permissions := strings.ToLower(cleanLine(s[1 : len(s)-1]))
-		f := strings.Split(permissions, ",")
+		f, err := protocol.SplitPatternList(permissions)
+		if err != nil {
+			return nil, fmt.Errorf("not valid permissions: %s", s)
+		}
 		r := make([]string, 0, len(f))
 		for _, p := range f {
 			p = cleanLine(p)
 			if len(p) == 0 {
 				continue
 			}
+			if protocol.IsRoleRef(p) {
+				if err := protocol.ValidRoleName(p[1:]); err != nil {
+					return nil, err
+				}
+			} else if err := protocol.ValidPermission(p); err != nil {
+				return nil, err
+			}
 			r = append(r, p)
 		}
 		return r, nil
@@ -175,6 +507,127 @@ func parsePermissions(s string) ([]string, error) {
 	return nil, fmt.Errorf("not valid permissions: %s", s)
 }
 
+// parseRole parses "name [permissions...]" into roles.
+func parseRole(roles protocol.Roles, s string) error {
+	f := strings.SplitN(s, " ", 2)
+	if len(f) != 2 {
+		return fmt.Errorf("bad format: \"%s\"", s)
+	}
+	name := strings.ToLower(f[0])
+	if err := protocol.ValidRoleName(name); err != nil {
+		return err
+	}
+	if _, ok := roles[name]; ok {
+		return fmt.Errorf("duplicate role: \"%s\"", name)
+	}
+	permissions, err := parsePermissions(cleanLine(f[1]))
+	if err != nil {
+		return err
+	}
+	roles[name] = permissions
+	return nil
+}
+
+// expandRoles replaces role references in all permission lists and keeps the lists
+// as configured.
+func expandRoles(c *protocol.Config) error {
+	expand := func(permissions, declared *[]string) error {
+		expanded, err := c.Roles.Expand(*permissions)
+		if err != nil {
+			return err
+		}
+		for _, p := range *permissions {
+			if protocol.IsRoleRef(p) {
+				*declared = *permissions
+				break
+			}
+		}
+		*permissions = expanded
+		return nil
+	}
+	for name, role := range c.Roles {
+		if _, err := c.Roles.Expand(role); err != nil {
+			return fmt.Errorf("role %s: %s", name, err)
+		}
+	}
+	for i := range c.Identities {
+		if err := expand(&c.Identities[i].Permissions, &c.Identities[i].Declared); err != nil {
+			return err
+		}
+	}
+	for i := range c.Peers {
+		if err := expand(&c.Peers[i].Permissions, &c.Peers[i].Declared); err != nil {
+			return err
+		}
+	}
+	for i := range c.Users {
+		u := &c.Users[i]
+		if err := expand(&u.Permissions, &u.Declared); err != nil {
+			return err
+		}
+		for _, p := range u.Permissions {
+			if strings.ContainsAny(p, "@~") {
+				return fmt.Errorf("user permissions cannot be scoped or windowed: \"%s\"", p)
+			}
+		}
+	}
+	return nil
+}
+
+// parseWindow parses "name window" into windows. Several windows may have the same name.
+func parseWindow(windows protocol.Windows, s string) error {
+	f := strings.SplitN(s, " ", 2)
+	if len(f) != 2 {
+		return fmt.Errorf("bad format: \"%s\"", s)
+	}
+	name := strings.ToLower(f[0])
+	if err := protocol.ValidRoleName(name); err != nil {
+		return fmt.Errorf("bad window name: \"%s\"", f[0])
+	}
+	w, err := protocol.ParseWindow(f[1])
+	if err != nil {
+		return err
+	}
+	windows[name] = append(windows[name], w)
+	return nil
+}
+
+// parseQuorum parses "verb signers".
+func parseQuorum(s string) (*protocol.Quorum, error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return nil, fmt.Errorf("bad format: \"%s\"", s)
+	}
+	verb := strings.ToLower(f[0])
+	if err := protocol.ValidQuorumVerb(verb); err != nil {
+		return nil, err
+	}
+	signers, err := strconv.Atoi(f[1])
+	if err != nil || signers < 1 {
+		return nil, fmt.Errorf("bad number of signers: \"%s\"", f[1])
+	}
+	return &protocol.Quorum{Verb: verb, Signers: signers}, nil
+}
+
+// checkWindows returns an error if a permission entry refers to an unknown window.
+func checkWindows(c *protocol.Config) error {
+	lists := make([][]string, 0, len(c.Identities)+len(c.Peers))
+	for _, i := range c.Identities {
+		lists = append(lists, i.Permissions)
+	}
+	for _, p := range c.Peers {
+		lists = append(lists, p.Permissions)
+	}
+	for _, permissions := range lists {
+		for _, p := range permissions {
+			if w := protocol.PermissionWindow(p); w != "" && c.Windows[w] == nil {
+				return fmt.Errorf("unknown window: \"%s\"", w)
+			}
+		}
+	}
+	return nil
+}
+
 func parseIdentity(s string) (identity *protocol.Identity, err error) {
 	ret := new(protocol.Identity)
 	f := strings.SplitN(s, " ", 3)
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"testing"
+	"time"
 
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/btcsuite/btcutil/base58"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,3 +26,282 @@ func TestParseFile(t *testing.T) {
 	}
 	assert.Equal(t, config, config1)
 }
+
+func TestParseConfig_Users(t *testing.T) {
+	c := protocol.NewConfig()
+	d := fmt.Sprintf("%s\n\n[ Users ]\ndeploy %s [deploy, ping]\n", c, base58.Encode(c.DefaultKey))
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if !config.Users.Permitted([]string{"1001", "deploy"}, c.DefaultKey, "ping") {
+		t.Error("User not permitted")
+	}
+	if config.Users.Permitted([]string{"deploy"}, c.DefaultKey, "restart") {
+		t.Error("User permitted for wrong verb")
+	}
+	public := config.Public([]string{"deploy"})
+	if len(public.Identities) != 1 || public.Identities[0].PrivateKey != nil {
+		t.Error("Public config contains private key")
+	}
+	if len(config.Public([]string{"other"}).Identities) != 0 {
+		t.Error("Public config contains foreign identity")
+	}
+	other := protocol.NewConfig()
+	d = fmt.Sprintf("%s\n\n[ Users ]\ndeploy %s [deploy]\n", c, base58.Encode(other.DefaultKey))
+	if _, err := ParseConfig([]byte(d)); err == nil {
+		t.Error("Unknown identity accepted")
+	}
+}
+
+func TestParseConfig_Handlers(t *testing.T) {
+	c := protocol.NewConfig()
+	sender := base58.Encode(c.DefaultKey)
+	d := fmt.Sprintf("%s\n\n[ Handlers ]\nping /bin/echo pong\ndeploy dest=web* sender=%s dir=/srv timeout=1m0s user=deploy delivery=file output_limit=4096 /usr/local/bin/deploy.sh -v\n", c, sender)
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if len(config.Handlers) != 2 {
+		t.Fatalf("Handlers: %d", len(config.Handlers))
+	}
+	h := config.Handlers[1]
+	if h.Verb != "deploy" || h.Destination != "web*" || h.Dir != "/srv" || h.Timeout != time.Minute || h.User != "deploy" || h.Delivery != protocol.DeliveryFile || h.OutputLimit != 4096 {
+		t.Errorf("Options not parsed: %s", h.String())
+	}
+	if len(h.Command) != 2 || h.Command[0] != "/usr/local/bin/deploy.sh" {
+		t.Errorf("Command not parsed: %v", h.Command)
+	}
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	if again.Handlers[1].String() != h.String() {
+		t.Errorf("Round trip: %s != %s", again.Handlers[1].String(), h.String())
+	}
+	if _, err := ParseConfig([]byte(fmt.Sprintf("%s\n\n[ Handlers ]\nping timeout=1m\n", c))); err == nil {
+		t.Error("Handler without command accepted")
+	}
+	if _, err := ParseConfig([]byte(fmt.Sprintf("%s\n\n[ Handlers ]\nping delivery=pipe /bin/cat\n", c))); err == nil {
+		t.Error("Unknown delivery accepted")
+	}
+	d = fmt.Sprintf("%s\n\n[ Handlers ]\nbuild user=ci group=ci groups=docker,adm umask=027 rlimit_cpu=10m rlimit_memory=2G rlimit_nofile=1024 no_new_privs=true make\n", c)
+	if config, err = ParseConfig([]byte(d)); err != nil {
+		t.Fatalf("Parse limits: %s", err)
+	}
+	h = config.Handlers[0]
+	if h.Group != "ci" || len(h.Groups) != 2 || h.Umask != "027" || h.RlimitCPU != 10*time.Minute || h.RlimitMemory != 2<<30 || h.RlimitNofile != 1024 || !h.NoNewPrivs {
+		t.Errorf("Limits not parsed: %s", h.String())
+	}
+	if again, err = ParseConfig([]byte(config.String())); err != nil || again.Handlers[0].String() != h.String() {
+		t.Errorf("Round trip limits: %v", err)
+	}
+	if _, err := ParseConfig([]byte(fmt.Sprintf("%s\n\n[ Handlers ]\nping umask=999 /bin/true\n", c))); err == nil {
+		t.Error("Bad umask accepted")
+	}
+	for _, bad := range []string{"rlimit_memory=", "rlimit_memory=K", "groups=", "groups=docker,,adm"} {
+		if _, err := ParseConfig([]byte(fmt.Sprintf("%s\n\n[ Handlers ]\nping %s /bin/true\n", c, bad))); err == nil {
+			t.Errorf("Accepted: %s", bad)
+		}
+	}
+}
+
+func TestParseConfig_Workers(t *testing.T) {
+	c := protocol.NewConfig()
+	d := fmt.Sprintf("workers: 4\nworker_queue: 10\nworker_policy: reject\nworker_limit: download=2, deploy=1\n%s", c)
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if config.Workers != 4 || config.WorkerQueue != 10 || config.WorkerPolicy != protocol.PolicyReject {
+		t.Errorf("Workers not parsed: %d %d %s", config.Workers, config.WorkerQueue, config.WorkerPolicy)
+	}
+	assert.Equal(t, map[string]int{"download": 2, "deploy": 1}, config.WorkerLimits)
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.WorkerLimits, again.WorkerLimits)
+	if _, err := ParseConfig([]byte("worker_policy: lifo\n" + c.String())); err == nil {
+		t.Error("Unknown policy accepted")
+	}
+}
+
+func TestParseConfig_Labels(t *testing.T) {
+	c := protocol.NewConfig()
+	peer := protocol.NewConfig()
+	d := fmt.Sprintf("labels: role=db, env=prod\n%s\n\n[ Peers ]\ndb1 %s [ping] {role=db, env=staging}\nweb1 %s [ping]\n", c, base58.Encode(peer.DefaultKey), base58.Encode(c.DefaultKey))
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	assert.Equal(t, protocol.Labels{"role": "db", "env": "prod"}, config.Labels)
+	assert.Equal(t, protocol.Labels{"role": "db", "env": "staging"}, config.Peers[0].Labels)
+	assert.Nil(t, config.Peers[1].Labels)
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.Labels, again.Labels)
+	assert.Equal(t, config.Peers, again.Peers)
+	if _, err := ParseConfig([]byte("labels: role\n" + c.String())); err == nil {
+		t.Error("Bad label accepted")
+	}
+	d = fmt.Sprintf("%s\n\n[ Peers ]\ndb1 %s [ping] role=db\n", c, base58.Encode(peer.DefaultKey))
+	if _, err := ParseConfig([]byte(d)); err == nil {
+		t.Error("Peer labels without braces accepted")
+	}
+}
+
+func TestParseConfig_Permissions(t *testing.T) {
+	c := protocol.NewConfig()
+	peer := protocol.NewConfig()
+	d := fmt.Sprintf("%s\n\n[ Peers ]\nops %s [Ping, deploy.*, restart.{web,api}, !deploy.db]\n", c, base58.Encode(peer.DefaultKey))
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	assert.Equal(t, []string{"ping", "deploy.*", "restart.{web,api}", "!deploy.db"}, config.Peers[0].Permissions)
+	if !config.Peers.Known(peer.DefaultKey, "deploy.web") || config.Peers.Known(peer.DefaultKey, "deploy.db") {
+		t.Error("Permissions not applied")
+	}
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.Peers, again.Peers)
+	d = fmt.Sprintf("%s\n\n[ Peers ]\nops %s [deploy..web]\n", c, base58.Encode(peer.DefaultKey))
+	if _, err := ParseConfig([]byte(d)); err == nil {
+		t.Error("Bad permission accepted")
+	}
+	d = fmt.Sprintf("%s\n\n[ Peers ]\nops %s [restart@com.crypto.us.*, ping]\n", c, base58.Encode(peer.DefaultKey))
+	if config, err = ParseConfig([]byte(d)); err != nil {
+		t.Fatalf("Parse scoped: %s", err)
+	}
+	assert.Equal(t, []string{"restart@com.crypto.us.*", "ping"}, config.Peers[0].Permissions)
+	assert.True(t, config.Peers.KnownAt(peer.DefaultKey, "restart", "com.crypto.us.left"))
+	assert.False(t, config.Peers.KnownAt(peer.DefaultKey, "restart", "**"))
+	d = fmt.Sprintf("%s\n\n[ Peers ]\nops %s [restart@host[1-9], ping] {role=web}\n", c, base58.Encode(peer.DefaultKey))
+	if config, err = ParseConfig([]byte(d)); err != nil {
+		t.Fatalf("Parse scoped range: %s", err)
+	}
+	assert.Equal(t, []string{"restart@host[1-9]", "ping"}, config.Peers[0].Permissions)
+	assert.Equal(t, "web", config.Peers[0].Labels["role"])
+	assert.True(t, config.Peers.KnownAt(peer.DefaultKey, "restart", "host3"))
+	assert.False(t, config.Peers.KnownAt(peer.DefaultKey, "restart", "host10"))
+	for _, bad := range []string{"[!restart@com.*]", "[restart@com.{us]", "[restart@host[1-9]", "[restart@host[1-9]]]"} {
+		d = fmt.Sprintf("%s\n\n[ Peers ]\nops %s %s\n", c, base58.Encode(peer.DefaultKey), bad)
+		if _, err := ParseConfig([]byte(d)); err == nil {
+			t.Errorf("Bad scope accepted: %s", bad)
+		}
+	}
+	d = fmt.Sprintf("%s\n\n[ Users ]\ndeploy %s [restart@com.*]\n", c, base58.Encode(c.DefaultKey))
+	if _, err := ParseConfig([]byte(d)); err == nil {
+		t.Error("Scoped user permission accepted")
+	}
+}
+
+func TestParseConfig_Roles(t *testing.T) {
+	c := protocol.NewConfig()
+	peer := protocol.NewConfig()
+	d := fmt.Sprintf("%s\n\n[ Peers ]\nops %s [@Operator, !deploy.db]\n\n[ Roles ]\nreadonly [ping, status]\noperator [@readonly, deploy.*]\n", c, base58.Encode(peer.DefaultKey))
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	assert.Equal(t, []string{"ping", "status", "deploy.*", "!deploy.db"}, config.Peers[0].Permissions)
+	assert.Equal(t, []string{"@operator", "!deploy.db"}, config.Peers[0].Declared)
+	assert.Nil(t, config.Identities[0].Declared)
+	if !config.Peers.Known(peer.DefaultKey, "status") || config.Peers.Known(peer.DefaultKey, "deploy.db") {
+		t.Error("Role permissions not applied")
+	}
+	out := config.String()
+	assert.Contains(t, out, "[@operator, !deploy.db]")
+	assert.Contains(t, out, "[ Roles ]\noperator [@readonly, deploy.*]\nreadonly [ping, status]")
+	again, err := ParseConfig([]byte(out))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.Peers, again.Peers)
+	assert.Equal(t, config.Roles, again.Roles)
+	for _, bad := range []string{
+		"[ Peers ]\nops %s [@admin]\n",
+		"[ Peers ]\nops %s [ping]\n[ Roles ]\nloop [@loop]\n",
+		"[ Peers ]\nops %s [ping]\n[ Roles ]\nr [ping]\nr [status]\n",
+		"[ Peers ]\nops %s [@bad.name]\n",
+	} {
+		d = fmt.Sprintf("%s\n\n"+bad, c, base58.Encode(peer.DefaultKey))
+		if _, err := ParseConfig([]byte(d)); err == nil {
+			t.Errorf("Accepted: %s", bad)
+		}
+	}
+	d = fmt.Sprintf("%s\n\n[ Roles ]\nregional [restart@com.*]\n\n[ Users ]\ndeploy %s [@regional]\n", c, base58.Encode(c.DefaultKey))
+	if _, err := ParseConfig([]byte(d)); err == nil {
+		t.Error("Scoped user permission accepted through role")
+	}
+}
+
+func TestParseConfig_Windows(t *testing.T) {
+	c := protocol.NewConfig()
+	peer := protocol.NewConfig()
+	d := fmt.Sprintf("%s\n\n[ Windows ]\nmaintenance sat,sun 02:00-04:00\nmaintenance wed 22:00-23:30 Europe/Berlin\nfreeze 2026-12-20T00:00:00Z/2027-01-05T00:00:00Z\n\n[ Peers ]\nops %s [ping, reboot~maintenance, !deploy~freeze, deploy]\n", c, base58.Encode(peer.DefaultKey))
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	assert.Len(t, config.Windows["maintenance"], 2)
+	assert.Equal(t, "wed 22:00-23:30 Europe/Berlin", config.Windows["maintenance"][1].String())
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.Windows, again.Windows)
+	assert.Equal(t, config.Peers, again.Peers)
+	for _, bad := range []string{
+		"[ Peers ]\nops %s [reboot~maintenance]\n",
+		"[ Windows ]\nmaintenance someday\n[ Peers ]\nops %s [ping]\n",
+	} {
+		d = fmt.Sprintf("%s\n\n"+bad, c, base58.Encode(peer.DefaultKey))
+		if _, err := ParseConfig([]byte(d)); err == nil {
+			t.Errorf("Accepted: %s", bad)
+		}
+	}
+	d = fmt.Sprintf("%s\n\n[ Windows ]\nnight * 22:00-06:00\n\n[ Users ]\ndeploy %s [reboot~night]\n", c, base58.Encode(c.DefaultKey))
+	if _, err := ParseConfig([]byte(d)); err == nil {
+		t.Error("Windowed user permission accepted")
+	}
+}
+
+func TestParseConfig_Quorum(t *testing.T) {
+	c := protocol.NewConfig()
+	d := fmt.Sprintf("%s\n\n[ Quorum ]\ndrop_database 2\ndb.* 3\n", c)
+	config, err := ParseConfig([]byte(d))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	assert.Equal(t, protocol.Quorums{{Verb: "drop_database", Signers: 2}, {Verb: "db.*", Signers: 3}}, config.Quorums)
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.Quorums, again.Quorums)
+	for _, bad := range []string{"drop_database", "drop_database 0", "!drop_database 2", "drop@db 2", "a..b 2"} {
+		if _, err := ParseConfig([]byte(fmt.Sprintf("%s\n\n[ Quorum ]\n%s\n", c, bad))); err == nil {
+			t.Errorf("Accepted: %s", bad)
+		}
+	}
+}
+
+func TestParseConfig_MaxValidity(t *testing.T) {
+	c := protocol.NewConfig()
+	config, err := ParseConfig([]byte(fmt.Sprintf("max_validity: 2h\n%s\n", c)))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	assert.Equal(t, 2*time.Hour, config.MaxValidity)
+	again, err := ParseConfig([]byte(config.String()))
+	if err != nil {
+		t.Fatalf("Parse String(): %s", err)
+	}
+	assert.Equal(t, config.MaxValidity, again.MaxValidity)
+}
@@ -0,0 +1,267 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+var (
+	ErrAgentUnsupported = errors.New("operation not supported by agent")
+)
+
+const DefaultAgentSocket = "/run/remaphore/agent.sock"
+
+// Operations of the agent protocol.
+const (
+	AgentOpConfig  = "config"
+	AgentOpSend    = "send"
+	AgentOpRequest = "request"
+	AgentOpReceive = "receive"
+	AgentOpReply   = "reply"
+	AgentOpAck     = "ack"    // Sent on a receive connection when a message passed the filters of the client.
+	AgentOpCancel  = "cancel" // Sent on a request connection to cancel the request.
+)
+
+// AgentRequest is sent by the client to the agent as one JSON document per line.
+// Every connection carries one operation. Receive connections additionally carry replies.
+type AgentRequest struct {
+	Op              string               `json:"op"`
+	SenderPublicKey protocol.Base58Bytes `json:"sender,omitempty"`
+	Subject         string               `json:"subject,omitempty"`
+	Selector        string               `json:"selector,omitempty"`
+	Timeout         time.Duration        `json:"timeout,omitempty"`
+	Encrypt         bool                 `json:"encrypt,omitempty"`
+	Follow          bool                 `json:"follow,omitempty"`
+	CancelOnTimeout bool                 `json:"cancel_on_timeout,omitempty"`
+	OnlineOnly      bool                 `json:"online_only,omitempty"`
+	JetStream       bool                 `json:"jetstream,omitempty"`
+	Since           time.Duration        `json:"since,omitempty"`
+	StartSequence   uint64               `json:"start_sequence,omitempty"`
+	Durable         string               `json:"durable,omitempty"`
+	AckTimeout      time.Duration        `json:"ack_timeout,omitempty"` // Send: wait for acknowledgements.
+	Destination     string               `json:"destination,omitempty"`
+	Verb            string               `json:"verb,omitempty"`
+	Payload         string               `json:"payload,omitempty"`
+	UUID            string               `json:"uuid,omitempty"`
+	ReplyTo         []byte               `json:"reply_to,omitempty"` // Hash of the message to reply to.
+	Reply           *protocol.Message    `json:"reply,omitempty"`    // Reply to send, nil to not reply.
+}
+
+// AgentResponse is sent by the agent to the client as one JSON document per line.
+type AgentResponse struct {
+	Error   string            `json:"error,omitempty"`
+	Config  *protocol.Config  `json:"config,omitempty"`
+	Message *protocol.Message `json:"message,omitempty"`
+	Missing protocol.Peers    `json:"missing,omitempty"`
+	Offline protocol.Peers    `json:"offline,omitempty"`
+	Done    bool              `json:"done,omitempty"`
+}
+
+func (response *AgentResponse) err() error {
+	if len(response.Error) > 0 {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// agentClient is one connection to the agent.
+type agentClient struct {
+	conn  net.Conn
+	mutex sync.Mutex
+	enc   *json.Encoder
+	dec   *json.Decoder
+}
+
+func dialAgent(socket string) (*agentClient, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &agentClient{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+func (client *agentClient) send(request *AgentRequest) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.enc.Encode(request)
+}
+
+func (client *agentClient) receive() (*AgentResponse, error) {
+	ret := new(AgentResponse)
+	if err := client.dec.Decode(ret); err != nil {
+		return nil, err
+	}
+	return ret, ret.err()
+}
+
+// AgentConfig fetches the configuration from the agent. It contains no private keys.
+func AgentConfig(socket string) (*protocol.Config, error) {
+	client, err := dialAgent(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = client.conn.Close() }()
+	if err := client.send(&AgentRequest{Op: AgentOpConfig}); err != nil {
+		return nil, err
+	}
+	response, err := client.receive()
+	if err != nil {
+		return nil, err
+	}
+	if response.Config == nil {
+		return nil, protocol.ErrFormat
+	}
+	return response.Config, nil
+}
+
+func (request *Request) agentRequest(op, dest, verb, msg string, uuid ...string) *AgentRequest {
+	return &AgentRequest{
+		Op:              op,
+		SenderPublicKey: request.SenderPublicKey,
+		Subject:         request.Subject,
+		Selector:        request.Selector.String(),
+		Timeout:         request.Timeout,
+		Encrypt:         request.Encrypt,
+		Follow:          request.Follow,
+		CancelOnTimeout: request.CancelOnTimeout,
+		OnlineOnly:      request.OnlineOnly,
+		JetStream:       request.JetStream,
+		Since:           request.Since,
+		StartSequence:   request.StartSequence,
+		Durable:         request.Durable,
+		Destination:     dest,
+		Verb:            verb,
+		Payload:         msg,
+		UUID:            string(exuuid(uuid...)),
+	}
+}
+
+func (request *Request) dialAgent() (*agentClient, error) {
+	client, err := dialAgent(request.Agent)
+	if err != nil {
+		return nil, err
+	}
+	request.mutex.Lock()
+	request.agent = client
+	request.mutex.Unlock()
+	return client, nil
+}
+
+func (request *Request) agentSend(dest, verb, msg string, uuid ...string) error {
+	client, err := request.dialAgent()
+	if err != nil {
+		return err
+	}
+	if err := client.send(request.agentRequest(AgentOpSend, dest, verb, msg, uuid...)); err != nil {
+		return err
+	}
+	_, err = client.receive()
+	return err
+}
+
+func (request *Request) agentSendAck(ackTimeout time.Duration, dest, verb, msg string, uuid ...string) (protocol.Peers, error) {
+	client, err := request.dialAgent()
+	if err != nil {
+		return nil, err
+	}
+	req := request.agentRequest(AgentOpSend, dest, verb, msg, uuid...)
+	req.AckTimeout = ackTimeout
+	if err := client.send(req); err != nil {
+		return nil, err
+	}
+	response, err := client.receive()
+	if err != nil {
+		return nil, err
+	}
+	return response.Missing, nil
+}
+
+func (request *Request) agentSendRequest(handler ReplyHandlerFunc, dest, verb, msg string, uuid ...string) (missing, offline protocol.Peers, err error) {
+	client, err := request.dialAgent()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := client.send(request.agentRequest(AgentOpRequest, dest, verb, msg, uuid...)); err != nil {
+		return nil, nil, err
+	}
+	if request.isCancelled() {
+		_ = client.send(&AgentRequest{Op: AgentOpCancel})
+	}
+	for {
+		response, err := client.receive()
+		if err != nil {
+			if response != nil && response.Error == ErrNoneOnline.Error() {
+				return nil, response.Offline, ErrNoneOnline
+			}
+			return nil, nil, err
+		}
+		if response.Done {
+			return response.Missing, response.Offline, nil
+		}
+		if response.Message != nil {
+			handler(context.Background(), response.Message)
+		}
+	}
+}
+
+func (request *Request) agentReceive(handler HandlerFunc, matches ...protocol.MsgMatch) error {
+	ctx, done := request.newContext(0)
+	defer done()
+	client, err := request.dialAgent()
+	if err != nil {
+		return err
+	}
+	if err := client.send(request.agentRequest(AgentOpReceive, "", "", "")); err != nil {
+		return err
+	}
+	for {
+		response, err := client.receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if response.Done {
+			return nil
+		}
+		msgStr := response.Message
+		if msgStr == nil {
+			continue
+		}
+		var replied int32
+		var reply ReplyFunc
+		if msgStr.RequestReply {
+			reply = func(msg *protocol.Message) error {
+				// Partial replies may be sent from other goroutines and keep the reply open.
+				if !protocol.ParseReply(msg.Payload).Partial {
+					atomic.StoreInt32(&replied, 1)
+				}
+				return client.send(&AgentRequest{Op: AgentOpReply, ReplyTo: msgStr.Hash, Reply: msg})
+			}
+		}
+		matched := msgStr.Match(request.Config, matches...) && handler != nil
+		if matched {
+			if msgStr.Ack {
+				// The agent acknowledges delivery only for messages that pass the filters here.
+				_ = client.send(&AgentRequest{Op: AgentOpAck, ReplyTo: msgStr.Hash})
+			}
+			handler(ctx, msgStr, reply)
+		}
+		if msgStr.RequestReply && atomic.LoadInt32(&replied) == 0 || msgStr.Ack && !matched {
+			// Let the agent forget about the message.
+			_ = client.send(&AgentRequest{Op: AgentOpReply, ReplyTo: msgStr.Hash})
+		}
+	}
+}
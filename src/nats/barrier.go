@@ -0,0 +1,123 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+var (
+	ErrBarrierTimeout = errors.New("timeout waiting for barrier")
+)
+
+const (
+	BarrierVerb     = "barrier"
+	barrierInterval = time.Second
+)
+
+// Barrier announces the arrival at barrier name and waits until the expected peers have arrived too.
+// If count is larger than zero, count participants including this one are expected. Otherwise
+// all potential receivers of dest are expected. Arrivals are repeated until the barrier is complete,
+// so that late participants learn about early ones.
+// Barrier returns the peers that have arrived and the potential receivers of dest that have not.
+func (request *Request) Barrier(name, verb, dest string, count int) (arrived, missing protocol.Peers, err error) {
+	if len(request.Agent) > 0 {
+		return nil, nil, ErrAgentUnsupported
+	}
+	if dest == "" {
+		dest = "**"
+	}
+	if verb == "" {
+		verb = BarrierVerb
+	}
+	missing = make(protocol.Peers, 0, len(request.Config.Peers))
+	for _, p := range request.Config.PotentialReceivers(dest) {
+		if !request.Config.IsSelf(p.PublicKey) {
+			missing = append(missing, p)
+		}
+	}
+	if count <= 0 && len(missing) == 0 {
+		return nil, nil, ErrNoReceivers
+	}
+	ctx, done := request.newContext(request.Timeout)
+	defer done()
+	conn, err := request.connect()
+	if err != nil {
+		return nil, missing, err
+	}
+	request.conn = conn
+	subject := mkSubject(request.Config.Subject, request.Subject, "barrier")
+	sub, err := conn.SubscribeSync(subject)
+	if err != nil {
+		return nil, missing, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	announce := func() error {
+		msgOut, err := (&protocol.Message{
+			SenderPublicKey: request.SenderPublicKey,
+			Destination:     dest,
+			UUID:            []byte(name),
+			Verb:            verb,
+		}).EncodeMessage(request.Config)
+		if err != nil {
+			return err
+		}
+		if err := conn.Publish(subject, msgOut); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}
+	if err := announce(); err != nil {
+		return nil, missing, err
+	}
+	go func() {
+		ticker := time.NewTicker(barrierInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := announce(); err != nil {
+					log.Printf("Barrier announce: %s", err)
+				}
+			}
+		}
+	}()
+	matches := []protocol.MsgMatch{
+		protocol.MatchUUID([]byte(name)),
+		protocol.MatchVerb(verb),
+	}
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			return arrived, missing, ErrBarrierTimeout
+		}
+		if msg == nil {
+			continue
+		}
+		msgStr, err := protocol.DecodeMessage(request.Config, msg.Data)
+		if err != nil {
+			log.Printf("Message error: %s", err)
+			continue
+		}
+		if request.Config.IsSelf(msgStr.SenderPublicKey) || msgStr.Destination != dest || !msgStr.Match(request.Config, matches...) {
+			continue
+		}
+		if arrived.Known(msgStr.SenderPublicKey) {
+			continue
+		}
+		arrived = append(arrived, protocol.Peer{
+			PublicKey:   msgStr.SenderPublicKey,
+			Destination: request.Config.Peers.Destination(msgStr.SenderPublicKey),
+		})
+		missing = missing.Remove(msgStr.SenderPublicKey)
+		if (count > 0 && len(arrived)+1 >= count) || (count <= 0 && len(missing) == 0) {
+			// Announce once more for participants that arrived after the last announcement.
+			return arrived, missing, announce()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package nats
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// cancelGrace is how long replies of cancelled receivers are awaited.
+const cancelGrace = 2 * time.Second
+
+// Cancel stops a running SendRequest or Acquire. A request is cancelled at the receivers
+// that have not sent their final reply, and their replies are awaited for a short time.
+func (request *Request) Cancel() {
+	atomic.StoreInt32(&request.cancelled, 1)
+	request.mutex.Lock()
+	agent, done := request.agent, request.done
+	request.mutex.Unlock()
+	if agent != nil {
+		_ = agent.send(&AgentRequest{Op: AgentOpCancel})
+		return
+	}
+	if done != nil {
+		done()
+	}
+}
+
+func (request *Request) isCancelled() bool {
+	return atomic.LoadInt32(&request.cancelled) != 0
+}
+
+// cancelRequest sends a cancel message for msgStr and collects the replies of missing
+// receivers until they all replied or cancelGrace expires.
+func (request *Request) cancelRequest(conn *nats.Conn, handler ReplyHandlerFunc, sub *nats.Subscription, msgStr *protocol.Message, missing protocol.Peers) (protocol.Peers, error) {
+	msgOut, err := protocol.NewCancel(msgStr).EncodeMessage(request.Config)
+	if err != nil {
+		return missing, err
+	}
+	if err := conn.Publish(request.cancelSubject(), msgOut); err != nil {
+		return missing, err
+	}
+	if err := conn.Flush(); err != nil {
+		return missing, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelGrace)
+	defer cancel()
+	return request.receiveReplies(ctx, handler, sub, missing)
+}
+
+// cancelSubject is the subject cancel messages are sent on. Receivers listen on it
+// separately, so that a cancel is seen while a handler blocks the message loop.
+func (request *Request) cancelSubject() string {
+	return mkSubject(request.Config.Subject, request.Subject, "cancel")
+}
+
+// subscribeCancel cancels the running requests that cancel messages matching matches refer to.
+func (request *Request) subscribeCancel(conn *nats.Conn, running *runningRequests, matches ...protocol.MsgMatch) (*nats.Subscription, error) {
+	return conn.Subscribe(request.cancelSubject(), func(msg *nats.Msg) {
+		msgStr, err := protocol.DecodeMessage(request.Config, msg.Data)
+		if err != nil {
+			log.Printf("Message error: %s", err)
+			return
+		}
+		running.cancelMatching(request.Config, msgStr, matches...)
+	})
+}
+
+// runningRequests are the requests being handled by a receiver, by hash.
+type runningRequests struct {
+	mutex   sync.Mutex
+	entries map[string]*runningRequest
+}
+
+type runningRequest struct {
+	verb   string
+	cancel context.CancelFunc
+}
+
+func newRunningRequests() *runningRequests {
+	return &runningRequests{entries: make(map[string]*runningRequest)}
+}
+
+// add registers msgStr and returns the context to handle it in, and a function to
+// call when handling is finished.
+func (running *runningRequests) add(ctx context.Context, msgStr *protocol.Message) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	key := hex.EncodeToString(msgStr.Hash)
+	running.mutex.Lock()
+	running.entries[key] = &runningRequest{verb: msgStr.Verb, cancel: cancel}
+	running.mutex.Unlock()
+	return ctx, func() {
+		running.mutex.Lock()
+		delete(running.entries, key)
+		running.mutex.Unlock()
+		cancel()
+	}
+}
+
+// cancelMatching cancels the request referenced by the cancel message msgStr, if
+// msgStr matches like the request it cancels.
+func (running *runningRequests) cancelMatching(c *protocol.Config, msgStr *protocol.Message, matches ...protocol.MsgMatch) {
+	if !msgStr.IsCancel() {
+		return
+	}
+	request := *msgStr
+	request.Verb = msgStr.PermissionVerb()
+	if request.Match(c, matches...) {
+		running.cancel(msgStr)
+	}
+}
+
+// cancel cancels the request referenced by the cancel message msgStr, if it is
+// running and has the verb the sender of msgStr was permitted to cancel.
+func (running *runningRequests) cancel(msgStr *protocol.Message) {
+	running.mutex.Lock()
+	defer running.mutex.Unlock()
+	entry, ok := running.entries[msgStr.Payload]
+	if !ok || entry.verb != msgStr.PermissionVerb() {
+		return
+	}
+	log.Printf("Cancelled: %s", msgStr.Payload)
+	entry.cancel()
+}
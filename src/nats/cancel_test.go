@@ -0,0 +1,24 @@
+package nats
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRequest_Cancel(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		var wg sync.WaitGroup
+		request := new(Request)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request.Cancel()
+		}()
+		ctx, done := request.newContext(0)
+		wg.Wait()
+		if ctx.Err() == nil {
+			t.Fatal("context not cancelled")
+		}
+		done()
+	}
+}
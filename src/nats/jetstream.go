@@ -0,0 +1,130 @@
+package nats
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+// ensureStream creates the configured stream for subject unless it exists already.
+// Subjects the stream does not capture yet are added to it.
+func (request *Request) ensureStream(js nats.JetStreamContext, subject string) error {
+	info, err := js.StreamInfo(request.Config.Stream)
+	if err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     request.Config.Stream,
+			Subjects: []string{subject},
+			MaxAge:   request.Config.MaxReplayAge,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range info.Config.Subjects {
+		if subjectMatches(s, subject) {
+			return nil
+		}
+	}
+	config := info.Config
+	config.Subjects = append(config.Subjects, subject)
+	_, err = js.UpdateStream(&config)
+	return err
+}
+
+// subjectMatches returns true if subject is matched by filter, which may contain the
+// NATS wildcards * and >.
+func subjectMatches(filter, subject string) bool {
+	f, s := strings.Split(filter, "."), strings.Split(subject, ".")
+	for i, t := range f {
+		if t == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || t != "*" && t != s[i] {
+			return false
+		}
+	}
+	return len(f) == len(s)
+}
+
+// publish sends a message, either directly or into the stream if JetStream mode is enabled.
+func (request *Request) publish(conn *nats.Conn, subject string, data []byte) error {
+	if !request.JetStream {
+		if err := conn.Publish(subject, data); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return err
+	}
+	if err := request.ensureStream(js, subject); err != nil {
+		return err
+	}
+	_, err = js.Publish(subject, data)
+	return err
+}
+
+// subscribe subscribes to subject, either directly or by creating a consumer on the stream
+// if JetStream mode is enabled.
+func (request *Request) subscribe(conn *nats.Conn, subject string) (*nats.Subscription, error) {
+	if !request.JetStream {
+		return conn.SubscribeSync(subject)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := request.ensureStream(js, subject); err != nil {
+		return nil, err
+	}
+	opts := []nats.SubOpt{nats.BindStream(request.Config.Stream)}
+	switch {
+	case request.StartSequence > 0:
+		opts = append(opts, nats.StartSequence(request.StartSequence))
+	case request.Since > 0:
+		opts = append(opts, nats.StartTime(time.Now().Add(-request.Since)))
+	default:
+		opts = append(opts, nats.DeliverNew())
+	}
+	if len(request.Durable) > 0 {
+		opts = append(opts, nats.Durable(request.Durable), nats.AckExplicit())
+	} else {
+		opts = append(opts, nats.AckNone())
+	}
+	return js.SubscribeSync(subject, opts...)
+}
+
+// decode decodes a received message and returns until when it must be remembered for replay protection.
+func (request *Request) decode(msg *nats.Msg) (*protocol.Message, time.Time, error) {
+	if !request.JetStream {
+		msgStr, err := protocol.DecodeMessage(request.Config, msg.Data)
+		if err != nil {
+			return msgStr, time.Time{}, err
+		}
+		return msgStr, msgStr.ValidUntil(request.Config), nil
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	msgStr, err := protocol.DecodeStoredMessage(request.Config, msg.Data, meta.Timestamp)
+	if err != nil {
+		return msgStr, time.Time{}, err
+	}
+	until := meta.Timestamp.Add(request.Config.MaxReplayAge)
+	if t := msgStr.ValidUntil(request.Config); t.After(until) {
+		until = t
+	}
+	return msgStr, until, nil
+}
+
+// ack acknowledges a message to a durable consumer.
+func (request *Request) ack(msg *nats.Msg) {
+	if request.JetStream && len(request.Durable) > 0 {
+		_ = msg.Ack()
+	}
+}
@@ -0,0 +1,22 @@
+package nats
+
+import "testing"
+
+func TestSubjectMatches(t *testing.T) {
+	for _, c := range []struct {
+		filter, subject string
+		match           bool
+	}{
+		{"remaphore.all", "remaphore.all", true},
+		{"remaphore.all", "remaphore.other", false},
+		{"remaphore.*", "remaphore.other", true},
+		{"remaphore.*", "remaphore.other.cancel", false},
+		{"remaphore.>", "remaphore.other.cancel", true},
+		{"remaphore.>", "remaphore", false},
+		{"remaphore.all.x", "remaphore.all", false},
+	} {
+		if subjectMatches(c.filter, c.subject) != c.match {
+			t.Errorf("%s %s: expected %v", c.filter, c.subject, c.match)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package nats
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// job is one message waiting for or being handled by a worker.
+type job struct {
+	sender string
+	verb   string
+	run    func()
+}
+
+// workerPool executes handlers concurrently, limited by the number of workers and
+// the per-verb limits of the config. Messages of the same sender and verb start in
+// the order they were received, but may run concurrently.
+type workerPool struct {
+	workers int
+	queue   int
+	policy  string
+	limits  map[string]int
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	closed  bool
+	running int
+	verbs   map[string]int // Running jobs per verb.
+	waiting []*job
+	wg      sync.WaitGroup
+}
+
+// newWorkerPool returns a pool that stops starting jobs when ctx is done.
+func newWorkerPool(ctx context.Context, c *protocol.Config) *workerPool {
+	pool := &workerPool{
+		workers: c.Workers,
+		queue:   c.WorkerQueue,
+		policy:  c.WorkerPolicy,
+		limits:  c.WorkerLimits,
+		verbs:   make(map[string]int),
+	}
+	pool.cond = sync.NewCond(&pool.mutex)
+	go func() {
+		<-ctx.Done()
+		pool.stop()
+	}()
+	return pool
+}
+
+// order returns the key of the jobs that must start in the order they were submitted.
+// A job waiting for its verb limit does not hold back other verbs of the same sender.
+func (j *job) order() string {
+	return j.sender + "\x00" + j.verb
+}
+
+// canStart returns true if j can start now. Must be called with the mutex held.
+func (pool *workerPool) canStart(j *job) bool {
+	if pool.running >= pool.workers {
+		return false
+	}
+	limit, ok := pool.limits[j.verb]
+	return !ok || pool.verbs[j.verb] < limit
+}
+
+// start runs j in a new goroutine. Must be called with the mutex held.
+func (pool *workerPool) start(j *job) {
+	pool.running++
+	pool.verbs[j.verb]++
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+		j.run()
+		pool.finish(j)
+	}()
+}
+
+func (pool *workerPool) finish(j *job) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.running--
+	pool.verbs[j.verb]--
+	pool.schedule()
+	pool.cond.Broadcast()
+}
+
+// schedule starts waiting jobs in order. A job is skipped while an earlier job of the
+// same sender and verb is waiting. Must be called with the mutex held.
+func (pool *workerPool) schedule() {
+	if pool.closed {
+		return
+	}
+	blocked := make(map[string]bool)
+	waiting := pool.waiting[:0]
+	for _, j := range pool.waiting {
+		if !blocked[j.order()] && pool.canStart(j) {
+			pool.start(j)
+			continue
+		}
+		blocked[j.order()] = true
+		waiting = append(waiting, j)
+	}
+	for i := len(waiting); i < len(pool.waiting); i++ {
+		pool.waiting[i] = nil
+	}
+	pool.waiting = waiting
+}
+
+// orderWaiting returns true if a job that must start before j is waiting. Jobs only
+// wait if they cannot start, so j could not start either. Must be called with the mutex held.
+func (pool *workerPool) orderWaiting(j *job) bool {
+	for _, w := range pool.waiting {
+		if w.order() == j.order() {
+			return true
+		}
+	}
+	return false
+}
+
+// submit starts or queues j. It returns false if j was dropped because of the pool's
+// policy or the pool was stopped. With PolicyQueue, submit blocks until j can be queued.
+func (pool *workerPool) submit(j *job) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for !pool.closed {
+		if !pool.orderWaiting(j) && pool.canStart(j) {
+			pool.start(j)
+			return true
+		}
+		if len(pool.waiting) < pool.queue {
+			pool.waiting = append(pool.waiting, j)
+			return true
+		}
+		if pool.policy != protocol.PolicyQueue {
+			return false
+		}
+		pool.cond.Wait()
+	}
+	return false
+}
+
+// stop discards waiting jobs and wakes up blocked submits.
+func (pool *workerPool) stop() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.closed = true
+	pool.waiting = nil
+	pool.cond.Broadcast()
+}
+
+// close stops the pool and waits for running jobs to finish.
+func (pool *workerPool) close() {
+	pool.stop()
+	pool.wg.Wait()
+}
@@ -0,0 +1,111 @@
+package nats
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+func testPool(policy string, workers, queue int, limits map[string]int) *workerPool {
+	return newWorkerPool(context.Background(), &protocol.Config{
+		Workers:      workers,
+		WorkerQueue:  queue,
+		WorkerPolicy: policy,
+		WorkerLimits: limits,
+	})
+}
+
+func TestWorkerPool_SenderOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var order []int
+	pool := testPool(protocol.PolicyQueue, 4, 100, map[string]int{"deploy": 1})
+	for i := 0; i < 20; i++ {
+		i := i
+		pool.submit(&job{sender: "a", verb: "deploy", run: func() {
+			time.Sleep(time.Millisecond)
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+		}})
+	}
+	pool.close()
+	for i := range order {
+		if order[i] != i {
+			t.Fatalf("Out of order: %v", order)
+		}
+	}
+}
+
+func TestWorkerPool_SenderConcurrent(t *testing.T) {
+	var started sync.WaitGroup
+	release := make(chan struct{})
+	pool := testPool(protocol.PolicyDrop, 3, 0, map[string]int{"deploy": 1})
+	started.Add(3)
+	block := func() {
+		started.Done()
+		<-release
+	}
+	// Messages of one sender run concurrently, and a message waiting for its verb
+	// limit does not hold back other verbs.
+	for _, verb := range []string{"deploy", "ping", "ping"} {
+		if !pool.submit(&job{sender: "a", verb: verb, run: block}) {
+			t.Errorf("%s dropped with idle workers", verb)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Jobs of one sender not running concurrently")
+	}
+	close(release)
+	pool.close()
+}
+
+func TestWorkerPool_Limits(t *testing.T) {
+	var mutex sync.Mutex
+	var running, max int
+	pool := testPool(protocol.PolicyQueue, 8, 100, map[string]int{"deploy": 2})
+	for i := 0; i < 10; i++ {
+		pool.submit(&job{sender: string(rune('a' + i)), verb: "deploy", run: func() {
+			mutex.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}})
+	}
+	pool.close()
+	if max != 2 {
+		t.Errorf("Verb limit not applied: %d concurrent", max)
+	}
+}
+
+func TestWorkerPool_Drop(t *testing.T) {
+	release := make(chan struct{})
+	pool := testPool(protocol.PolicyDrop, 1, 1, nil)
+	block := func() { <-release }
+	if !pool.submit(&job{sender: "a", verb: "ping", run: block}) {
+		t.Error("First job dropped")
+	}
+	if !pool.submit(&job{sender: "b", verb: "ping", run: block}) {
+		t.Error("Queued job dropped")
+	}
+	if pool.submit(&job{sender: "c", verb: "ping", run: block}) {
+		t.Error("Job accepted with full queue")
+	}
+	close(release)
+	pool.close()
+}
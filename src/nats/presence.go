@@ -0,0 +1,161 @@
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	ErrNoneOnline = errors.New("no potential receivers online")
+)
+
+const (
+	PresenceVerb   = "presence"
+	presenceBucket = "remaphore_presence"
+	presenceTTL    = 24 * time.Hour // Nodes not seen for longer are forgotten.
+	presenceMissed = 3              // Heartbeats a node may miss before it is offline.
+)
+
+// Node is a configured peer and its last heartbeat.
+type Node struct {
+	Peer     protocol.Peer
+	Presence *protocol.Presence // Nil if no valid heartbeat was seen.
+	LastSeen time.Time
+	Online   bool
+}
+
+// presenceKV returns the key-value bucket that holds the last heartbeat of every node.
+func presenceKV(conn *nats.Conn) (nats.KeyValue, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(presenceBucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: presenceBucket, TTL: presenceTTL})
+	}
+	return kv, err
+}
+
+// heartbeat publishes a signed presence of the local node every interval until stop is closed.
+func (request *Request) heartbeat(conn *nats.Conn, interval time.Duration, verbs []string, stop <-chan struct{}) {
+	kv, err := presenceKV(conn)
+	if err != nil {
+		log.Printf("Presence error: %s", err)
+		return
+	}
+	presence := &protocol.Presence{
+		Destination: request.Config.Destination,
+		Version:     protocol.Version,
+		Started:     time.Now(),
+		ConfigHash:  request.Config.Hash(),
+		Verbs:       verbs,
+		Interval:    interval,
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		msg := &protocol.Message{
+			SenderPublicKey: request.SenderPublicKey,
+			Destination:     presence.Destination,
+			Verb:            PresenceVerb,
+			Payload:         presence.Encode(),
+		}
+		value, err := msg.EncodeReply(request.Config)
+		if err == nil {
+			_, err = kv.Put(base58.Encode(msg.SenderPublicKey), value)
+		}
+		if err != nil {
+			log.Printf("Presence error: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// nodePresence returns the presence in entry if it is signed by peer.
+func nodePresence(c *protocol.Config, entry nats.KeyValueEntry, peer *protocol.Peer) (*protocol.Presence, error) {
+	msg, err := protocol.DecodeReplyAt(c, entry.Value(), entry.Created())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(msg.SenderPublicKey, peer.PublicKey) || msg.Verb != PresenceVerb || msg.Destination != peer.Destination {
+		return nil, protocol.ErrFormat
+	}
+	presence, err := protocol.ParsePresence(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if presence.Destination != peer.Destination {
+		return nil, protocol.ErrFormat
+	}
+	return presence, nil
+}
+
+func (request *Request) nodes(conn *nats.Conn, peers protocol.Peers) ([]Node, error) {
+	kv, err := presenceKV(conn)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Node, 0, len(peers))
+	for _, peer := range peers {
+		node := Node{Peer: peer}
+		entry, err := kv.Get(base58.Encode(peer.PublicKey))
+		if err == nil && entry.Operation() == nats.KeyValuePut {
+			presence, err := nodePresence(request.Config, entry, &peer)
+			if err != nil {
+				log.Printf("Invalid presence of %s: %s", peer.Destination, err)
+			} else {
+				node.Presence = presence
+				node.LastSeen = entry.Created()
+				node.Online = time.Since(node.LastSeen) < presenceMissed*presence.Interval
+			}
+		} else if err != nil && err != nats.ErrKeyNotFound {
+			return nil, err
+		}
+		ret = append(ret, node)
+	}
+	return ret, nil
+}
+
+// Nodes returns the configured peers whose destination matches pattern and whose
+// labels match the request's selector with their presence. An empty pattern matches all peers.
+func (request *Request) Nodes(pattern string) ([]Node, error) {
+	if len(request.Agent) > 0 {
+		return nil, ErrAgentUnsupported
+	}
+	if pattern == "" {
+		pattern = "**"
+	}
+	conn, err := request.connect()
+	if err != nil {
+		return nil, err
+	}
+	request.conn = conn
+	return request.nodes(conn, request.Config.PotentialReceivers(pattern, request.Selector))
+}
+
+// onlineReceivers splits receivers into the ones that are online and the ones that are not.
+func (request *Request) onlineReceivers(conn *nats.Conn, receivers protocol.Peers) (online, offline protocol.Peers, err error) {
+	nodes, err := request.nodes(conn, receivers)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range nodes {
+		if node.Online {
+			online = append(online, node.Peer)
+		} else {
+			offline = append(offline, node.Peer)
+		}
+	}
+	return online, offline, nil
+}
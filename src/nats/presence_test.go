@@ -0,0 +1,48 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNodePresence(t *testing.T) {
+	node := protocol.NewConfig()
+	node.Destination = "com.crypto.us.left"
+	c := protocol.NewConfig()
+	peer := node.Identities[0].Peer(node.Destination)
+	c.Peers = append(c.Peers, *peer)
+	other := protocol.NewConfig()
+	c.Peers = append(c.Peers, *other.Identities[0].Peer("com.crypto.us.right"))
+	heartbeat := func(signer *protocol.Config, verb, dest, presenceDest string) []byte {
+		presence := &protocol.Presence{Destination: presenceDest, Version: protocol.Version, Started: time.Now(), Interval: time.Minute}
+		d, err := (&protocol.Message{
+			SenderPublicKey: signer.Identities[0].PublicKey,
+			Destination:     dest,
+			Verb:            verb,
+			Payload:         presence.Encode(),
+		}).EncodeReply(signer)
+		if err != nil {
+			t.Fatalf("EncodeReply: %s", err)
+		}
+		return d
+	}
+	for _, e := range []struct {
+		name  string
+		value []byte
+		valid bool
+	}{
+		{"valid", heartbeat(node, PresenceVerb, node.Destination, node.Destination), true},
+		{"other sender", heartbeat(other, PresenceVerb, node.Destination, node.Destination), false},
+		{"other verb", heartbeat(node, "ping", node.Destination, node.Destination), false},
+		{"other destination", heartbeat(node, PresenceVerb, "com.crypto.us.right", "com.crypto.us.right"), false},
+		{"other presence destination", heartbeat(node, PresenceVerb, node.Destination, "com.crypto.us.right"), false},
+	} {
+		entry := &testEntry{key: "key", value: e.value, created: time.Now(), op: nats.KeyValuePut}
+		if _, err := nodePresence(c, entry, peer); (err == nil) != e.valid {
+			t.Errorf("%s: %v", e.name, err)
+		}
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/hex"
 	"log"
+	"time"
 
 	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/nats-io/nats.go"
 )
 
 type ReplyFunc func(message *protocol.Message) error
@@ -13,23 +15,43 @@ type HandlerFunc func(ctx context.Context, message *protocol.Message, replyFunc
 type ReplyHandlerFunc func(ctx context.Context, message *protocol.Message)
 
 func (request *Request) Receive(handler HandlerFunc, matches ...protocol.MsgMatch) error {
-	var ctx context.Context
-	ctx, request.done = context.WithCancel(context.Background())
-	if request.Timeout > 0 {
-		ctx, request.done = context.WithTimeout(ctx, request.Timeout)
+	if len(request.Agent) > 0 {
+		return request.agentReceive(handler, matches...)
 	}
-	defer request.done()
-	conn, err := connect(request.Config)
+	ctx, done := request.newContext(request.Timeout)
+	defer done()
+	conn, err := request.connect()
 	if err != nil {
 		return err
 	}
 	request.conn = conn
+	replay, err := protocol.NewReplayCache(request.ReplayStore)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = replay.Close() }()
 	subject := mkSubject(request.Config.Subject, request.Subject)
-	sub, err := conn.SubscribeSync(subject)
+	sub, err := request.subscribe(conn, subject)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = sub.Unsubscribe() }()
+	var pool *workerPool
+	if request.Config.Workers > 0 {
+		pool = newWorkerPool(ctx, request.Config)
+		defer pool.close()
+	}
+	running := newRunningRequests()
+	csub, err := request.subscribeCancel(conn, running, matches...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = csub.Unsubscribe() }()
+	if request.Presence > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go request.heartbeat(conn, request.Presence, request.PresenceVerbs, stop)
+	}
 	log.Println("Ready")
 	for {
 		msg, err := sub.NextMsgWithContext(ctx)
@@ -37,32 +59,121 @@ func (request *Request) Receive(handler HandlerFunc, matches ...protocol.MsgMatc
 			return nil
 		}
 		if msg != nil {
-			msgStr, err := protocol.DecodeMessage(request.Config, msg.Data)
+			msgStr, until, err := request.decode(msg)
+			if err == nil {
+				err = replay.Verify(msgStr, until)
+			}
+			if err == protocol.ErrReplay {
+				log.Printf("Replayed message dropped: %s", hex.EncodeToString(msgStr.Hash))
+				request.ack(msg)
+				continue
+			}
 			if err != nil {
 				log.Printf("Message error: %s", err)
+				request.ack(msg)
 				continue
 			}
 			// if request.Config.IsSelf(msgStr.SenderPublicKey) {
 			// 	continue
 			// }
+			if msgStr.IsCancel() {
+				running.cancelMatching(request.Config, msgStr, matches...)
+				request.ack(msg)
+				continue
+			}
 			if msgStr.Match(request.Config, matches...) && handler != nil {
+				if msgStr.Ack {
+					ackReply := request.replyFunc(conn, msgStr)
+					if request.OnAck != nil {
+						request.OnAck(msgStr, func() { request.sendAck(ackReply) })
+					} else {
+						request.sendAck(ackReply)
+					}
+				}
 				var reply ReplyFunc
 				if msgStr.RequestReply {
-					replySubject := mkSubject(request.Config.Subject, hex.EncodeToString(msgStr.Hash))
-					reply = func(msg *protocol.Message) error {
-						msg.Verb = "reply"
-						msgO, err := msg.EncodeReply(request.Config)
-						if err != nil {
-							return err
-						}
-						if err := conn.Publish(replySubject, msgO); err != nil {
-							return err
-						}
-						return conn.Flush()
-					}
+					reply = request.replyFunc(conn, msgStr)
 				}
-				handler(ctx, msgStr, reply)
+				hctx, finish := running.add(ctx, msgStr)
+				if pool != nil {
+					request.dispatch(hctx, pool, handler, msg, msgStr, reply, finish)
+					continue
+				}
+				handler(hctx, msgStr, reply)
+				finish()
 			}
+			request.ack(msg)
+		}
+	}
+}
+
+// replyFunc returns a function that sends replies to msgStr. Replies to encrypted
+// messages are encrypted to the sender.
+func (request *Request) replyFunc(conn *nats.Conn, msgStr *protocol.Message) ReplyFunc {
+	replySubject := mkSubject(request.Config.Subject, hex.EncodeToString(msgStr.Hash))
+	return func(msg *protocol.Message) error {
+		msg.Verb = "reply"
+		if msgStr.Encrypted {
+			msg.Encrypted = true
+			msg.Recipients = []protocol.Base58Bytes{msgStr.SenderPublicKey}
+		}
+		msgO, err := msg.EncodeReply(request.Config)
+		if err != nil {
+			return err
+		}
+		if err := conn.Publish(replySubject, msgO); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}
+}
+
+// sendAck acknowledges the delivery of a message before it is handled.
+func (request *Request) sendAck(reply ReplyFunc) {
+	now := time.Now()
+	ack := &protocol.Reply{
+		Destination: request.Config.Destination,
+		Start:       now,
+		End:         now,
+		Status:      protocol.StatusAck,
+	}
+	if err := reply(&protocol.Message{Payload: ack.Encode()}); err != nil {
+		log.Printf("Ack error: %s", err)
+	}
+}
+
+// dispatch hands the message to the worker pool. The message is acknowledged when
+// the handler returns or the message is dropped. finish is called when handling ends.
+func (request *Request) dispatch(ctx context.Context, pool *workerPool, handler HandlerFunc, msg *nats.Msg, msgStr *protocol.Message, reply ReplyFunc, finish func()) {
+	j := &job{
+		sender: string(msgStr.SenderPublicKey),
+		verb:   msgStr.Verb,
+		run: func() {
+			handler(ctx, msgStr, reply)
+			finish()
+			request.ack(msg)
+		},
+	}
+	if pool.submit(j) {
+		return
+	}
+	finish()
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("Busy, message dropped: %s", hex.EncodeToString(msgStr.Hash))
+	if pool.policy == protocol.PolicyReject && reply != nil {
+		now := time.Now()
+		busy := &protocol.Reply{
+			Destination: request.Config.Destination,
+			ExitCode:    -1,
+			Start:       now,
+			End:         now,
+			Status:      protocol.StatusBusy,
+		}
+		if err := reply(&protocol.Message{Payload: busy.Encode()}); err != nil {
+			log.Printf("Reply error: %s", err)
 		}
 	}
+	request.ack(msg)
 }
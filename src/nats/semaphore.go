@@ -0,0 +1,201 @@
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+var (
+	ErrSemaphoreName    = errors.New("semaphore name contains forbidden character")
+	ErrSemaphoreTimeout = errors.New("timeout acquiring semaphore")
+	ErrSemaphoreParams  = errors.New("semaphore needs at least one permit and a ttl of at least 1s")
+)
+
+const (
+	SemaphoreVerb   = "acquire"
+	MinSemaphoreTTL = time.Second // Leases are refreshed every third of the ttl.
+	semaphoreBucket = "remaphore_semaphores"
+	semaphoreRetry  = time.Second
+)
+
+var semaphoreName = regexp.MustCompile(`^[-/_=a-zA-Z0-9]+(\.[-/_=a-zA-Z0-9]+)*$`)
+
+// Lease is a permit of a distributed counting semaphore. It is refreshed until released.
+type Lease struct {
+	request  *Request
+	kv       nats.KeyValue
+	name     string
+	key      string
+	ttl      time.Duration
+	mutex    sync.Mutex
+	revision uint64
+	stop     chan struct{}
+	lost     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// leaseConfig returns a copy of the config that accepts leases signed by the local identities.
+func leaseConfig(c *protocol.Config) *protocol.Config {
+	ret := *c
+	ret.Peers = make(protocol.Peers, 0, len(c.Peers)+len(c.Identities))
+	ret.Peers = append(ret.Peers, c.Peers...)
+	for _, i := range c.Identities {
+		ret.Peers = append(ret.Peers, *i.Peer(c.Destination))
+	}
+	return &ret
+}
+
+func (request *Request) leaseValue(name, key string, ttl time.Duration) ([]byte, error) {
+	return (&protocol.Message{
+		SenderPublicKey: request.SenderPublicKey,
+		Destination:     name,
+		UUID:            []byte(key),
+		Verb:            SemaphoreVerb,
+		Payload:         ttl.String(),
+	}).EncodeMessage(request.Config)
+}
+
+// leaseValid returns true if entry holds a lease that is signed by an authorised peer and has not expired.
+func leaseValid(c *protocol.Config, entry nats.KeyValueEntry, name string) bool {
+	if entry.Operation() != nats.KeyValuePut {
+		return false
+	}
+	msg, err := protocol.DecodeMessageAt(c, entry.Value(), entry.Created())
+	if err != nil {
+		log.Printf("Invalid lease %s: %s", entry.Key(), err)
+		return false
+	}
+	if msg.Verb != SemaphoreVerb || msg.Destination != name || !bytes.Equal(msg.UUID, protocol.NewUUID([]byte(entry.Key()))) {
+		return false
+	}
+	ttl, err := time.ParseDuration(msg.Payload)
+	if err != nil {
+		return false
+	}
+	return time.Since(entry.Created()) < ttl
+}
+
+// Acquire takes one of permits leases of the semaphore name. Leases expire ttl after their last refresh.
+// It blocks until a lease is available or the request timeout expires.
+func (request *Request) Acquire(name string, permits int, ttl time.Duration) (*Lease, error) {
+	if len(request.Agent) > 0 {
+		return nil, ErrAgentUnsupported
+	}
+	if !semaphoreName.MatchString(name) {
+		return nil, ErrSemaphoreName
+	}
+	if permits < 1 || ttl < MinSemaphoreTTL {
+		return nil, ErrSemaphoreParams
+	}
+	ctx, done := request.newContext(request.Timeout)
+	defer done()
+	conn, err := request.connect()
+	if err != nil {
+		return nil, err
+	}
+	request.conn = conn
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.KeyValue(semaphoreBucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: semaphoreBucket})
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkConfig := leaseConfig(request.Config)
+	for {
+		for slot := 0; slot < permits; slot++ {
+			key := fmt.Sprintf("%s.%d", name, slot)
+			value, err := request.leaseValue(name, key, ttl)
+			if err != nil {
+				return nil, err
+			}
+			revision, err := kv.Create(key, value)
+			if err != nil {
+				entry, err := kv.Get(key)
+				if err != nil || leaseValid(checkConfig, entry, name) {
+					continue
+				}
+				if revision, err = kv.Update(key, value, entry.Revision()); err != nil {
+					continue
+				}
+			}
+			lease := &Lease{
+				request:  request,
+				kv:       kv,
+				name:     name,
+				key:      key,
+				ttl:      ttl,
+				revision: revision,
+				stop:     make(chan struct{}),
+				lost:     make(chan struct{}),
+			}
+			lease.wg.Add(1)
+			go lease.refresh()
+			return lease, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrSemaphoreTimeout
+		case <-time.After(semaphoreRetry):
+		}
+	}
+}
+
+func (lease *Lease) refresh() {
+	defer lease.wg.Done()
+	ticker := time.NewTicker(lease.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+		}
+		value, err := lease.request.leaseValue(lease.name, lease.key, lease.ttl)
+		if err == nil {
+			lease.mutex.Lock()
+			var revision uint64
+			revision, err = lease.kv.Update(lease.key, value, lease.revision)
+			if err == nil {
+				lease.revision = revision
+			}
+			lease.mutex.Unlock()
+		}
+		if err != nil {
+			log.Printf("Lease %s lost: %s", lease.key, err)
+			close(lease.lost)
+			return
+		}
+	}
+}
+
+// Lost is closed when the lease could not be refreshed and may have been taken by somebody else.
+func (lease *Lease) Lost() <-chan struct{} {
+	return lease.lost
+}
+
+// Release returns the lease to the semaphore.
+func (lease *Lease) Release() error {
+	close(lease.stop)
+	lease.wg.Wait()
+	select {
+	case <-lease.lost:
+		return nil
+	default:
+	}
+	lease.mutex.Lock()
+	defer lease.mutex.Unlock()
+	return lease.kv.Delete(lease.key, nats.LastRevision(lease.revision))
+}
@@ -0,0 +1,144 @@
+package nats
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+	"github.com/nats-io/nats.go"
+)
+
+type testEntry struct {
+	key     string
+	value   []byte
+	created time.Time
+	op      nats.KeyValueOp
+}
+
+func (entry *testEntry) Bucket() string             { return semaphoreBucket }
+func (entry *testEntry) Key() string                { return entry.key }
+func (entry *testEntry) Value() []byte              { return entry.value }
+func (entry *testEntry) Revision() uint64           { return 1 }
+func (entry *testEntry) Created() time.Time         { return entry.created }
+func (entry *testEntry) Delta() uint64              { return 0 }
+func (entry *testEntry) Operation() nats.KeyValueOp { return entry.op }
+
+// testKV records updates and deletes. Other methods are not implemented.
+type testKV struct {
+	nats.KeyValue
+	mutex     sync.Mutex
+	updates   int
+	deleted   []string
+	updateErr error
+}
+
+func (kv *testKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.updateErr != nil {
+		return 0, kv.updateErr
+	}
+	kv.updates++
+	return last + 1, nil
+}
+
+func (kv *testKV) Delete(key string, opts ...nats.DeleteOpt) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.deleted = append(kv.deleted, key)
+	return nil
+}
+
+func TestLeaseValid(t *testing.T) {
+	c := protocol.NewConfig()
+	c.Identities[0].Permissions = []string{SemaphoreVerb}
+	other := protocol.NewConfig()
+	other.Identities[0].Permissions = []string{SemaphoreVerb}
+	request := &Request{Config: c}
+	value, err := request.leaseValue("build", "build.0", time.Minute)
+	if err != nil {
+		t.Fatalf("leaseValue: %s", err)
+	}
+	short, err := request.leaseValue("build", "build.0", time.Second)
+	if err != nil {
+		t.Fatalf("leaseValue: %s", err)
+	}
+	foreign, err := (&Request{Config: other}).leaseValue("build", "build.0", time.Minute)
+	if err != nil {
+		t.Fatalf("leaseValue: %s", err)
+	}
+	check := leaseConfig(c)
+	now := time.Now()
+	for _, e := range []struct {
+		name  string
+		entry testEntry
+		valid bool
+	}{
+		{"valid", testEntry{"build.0", value, now, nats.KeyValuePut}, true},
+		{"expired", testEntry{"build.0", short, now.Add(-2 * time.Second), nats.KeyValuePut}, false},
+		{"created long before signed", testEntry{"build.0", value, now.Add(-2 * time.Minute), nats.KeyValuePut}, false},
+		{"deleted", testEntry{"build.0", value, now, nats.KeyValueDelete}, false},
+		{"other key", testEntry{"build.1", value, now, nats.KeyValuePut}, false},
+		{"unknown signer", testEntry{"build.0", foreign, now, nats.KeyValuePut}, false},
+	} {
+		if leaseValid(check, &e.entry, "build") != e.valid {
+			t.Errorf("%s: valid %v", e.name, !e.valid)
+		}
+	}
+	if leaseValid(check, &testEntry{"build.0", value, now, nats.KeyValuePut}, "deploy") {
+		t.Error("lease of other semaphore valid")
+	}
+}
+
+func testLease(kv nats.KeyValue, ttl time.Duration) *Lease {
+	c := protocol.NewConfig()
+	c.Identities[0].Permissions = []string{SemaphoreVerb}
+	lease := &Lease{
+		request:  &Request{Config: c},
+		kv:       kv,
+		name:     "build",
+		key:      "build.0",
+		ttl:      ttl,
+		revision: 1,
+		stop:     make(chan struct{}),
+		lost:     make(chan struct{}),
+	}
+	lease.wg.Add(1)
+	go lease.refresh()
+	return lease
+}
+
+func TestLease_Release(t *testing.T) {
+	kv := new(testKV)
+	lease := testLease(kv, 30*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %s", err)
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if kv.updates == 0 {
+		t.Error("lease not refreshed")
+	}
+	if len(kv.deleted) != 1 || kv.deleted[0] != "build.0" {
+		t.Errorf("deleted: %v", kv.deleted)
+	}
+}
+
+func TestLease_Lost(t *testing.T) {
+	kv := &testKV{updateErr: errors.New("wrong last sequence")}
+	lease := testLease(kv, 30*time.Millisecond)
+	select {
+	case <-lease.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lease not lost")
+	}
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %s", err)
+	}
+	if len(kv.deleted) != 0 {
+		t.Errorf("lost lease deleted: %v", kv.deleted)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aurora-is-near/remaphore/src/protocol"
@@ -20,20 +21,83 @@ type Request struct {
 	Config          *protocol.Config
 	SenderPublicKey protocol.Base58Bytes
 	Subject         string
+	Selector        protocol.Selector // Labels receivers must have.
 	Timeout         time.Duration
+	ReplayStore     string // File to persist seen messages in, for replay protection across restarts.
+	Encrypt         bool   // Encrypt payloads to the potential receivers.
+	Follow          bool   // Request output to be streamed in partial replies.
+	CancelOnTimeout bool   // Cancel the request at receivers that did not finish before the timeout.
+	OnlineOnly      bool   // Only wait for replies of receivers that publish presence heartbeats.
 
-	conn *nats.Conn
-	done context.CancelFunc
+	// Receive: if set, OnAck is called with a function that acknowledges the delivery of
+	// messages that ask for it, instead of acknowledging them before they are handled.
+	OnAck func(msgStr *protocol.Message, ack func())
+
+	// Receive: publish presence heartbeats every Presence, announcing PresenceVerbs as served.
+	Presence      time.Duration
+	PresenceVerbs []string
+
+	// JetStream mode: messages are sent to and received from the configured stream.
+	JetStream     bool
+	Since         time.Duration // Receive messages stored within this duration.
+	StartSequence uint64        // Receive messages starting at this stream sequence.
+	Durable       string        // Resume from a durable consumer of this name.
+
+	Conn  *nats.Conn // Connection to use instead of connecting. It is not closed by Close.
+	Agent string     // Path of the agent socket. If set, requests are executed by the agent.
+
+	conn      *nats.Conn
+	mutex     sync.Mutex // Protects agent and done, which Cancel uses from other goroutines.
+	agent     *agentClient
+	done      context.CancelFunc
+	cancelled int32
 }
 
 func (request *Request) Close() {
-	if request.done != nil {
-		request.done()
+	request.mutex.Lock()
+	agent, done := request.agent, request.done
+	request.mutex.Unlock()
+	if done != nil {
+		done()
 	}
-	if request.conn != nil {
+	if request.conn != nil && request.conn != request.Conn {
 		request.conn.Close()
 	}
 	request.conn = nil
+	if agent != nil {
+		_ = agent.conn.Close()
+	}
+}
+
+// newContext returns the context of an operation, which expires after timeout if it is
+// positive. Cancel and Close cancel it, and it is cancelled already if Cancel was called.
+func (request *Request) newContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	request.mutex.Lock()
+	request.done = cancel
+	request.mutex.Unlock()
+	if request.isCancelled() {
+		cancel()
+	}
+	return ctx, cancel
+}
+
+// Connect connects to the NATS servers of the config.
+func Connect(config *protocol.Config) (*nats.Conn, error) {
+	return connect(config)
+}
+
+func (request *Request) connect() (*nats.Conn, error) {
+	if request.Conn != nil {
+		return request.Conn, nil
+	}
+	return connect(request.Config)
 }
 
 func connect(config *protocol.Config) (*nats.Conn, error) {
@@ -62,6 +126,15 @@ func mkSubject(parts ...string) string {
 	return strings.Join(o, ".")
 }
 
+// PotentialReceivers returns the peers expected to accept a message of verb sent to dest.
+func (request *Request) PotentialReceivers(dest, verb string) protocol.Peers {
+	sender := request.SenderPublicKey
+	if len(sender) == 0 {
+		sender = request.Config.DefaultKey
+	}
+	return request.Config.PotentialReceiversFor(sender, verb, dest, request.Selector)
+}
+
 func exuuid(uuid ...string) []byte {
 	if uuid == nil || len(uuid) == 0 || len(uuid[0]) == 0 {
 		return nil
@@ -73,7 +146,10 @@ func (request *Request) Send(dest, verb, msg string, uuid ...string) error {
 	if dest == "" {
 		dest = "**"
 	}
-	conn, err := connect(request.Config)
+	if len(request.Agent) > 0 {
+		return request.agentSend(dest, verb, msg, uuid...)
+	}
+	conn, err := request.connect()
 	if err != nil {
 		return err
 	}
@@ -81,74 +157,155 @@ func (request *Request) Send(dest, verb, msg string, uuid ...string) error {
 	msgOut, err := (&protocol.Message{
 		SenderPublicKey: request.SenderPublicKey,
 		Destination:     dest,
+		Selector:        request.Selector,
 		RequestReply:    false,
 		UUID:            exuuid(uuid...),
 		Verb:            verb,
 		Payload:         msg,
+		Encrypted:       request.Encrypt,
 	}).EncodeMessage(request.Config)
 	if err != nil {
 		return err
 	}
 	subject := mkSubject(request.Config.Subject, request.Subject)
-	if err := conn.Publish(subject, msgOut); err != nil {
+	return request.publish(conn, subject, msgOut)
+}
+
+// Publish sends an encoded message unchanged, e.g. one signed by several signers. Its
+// signatures are verified, its permissions are checked by the receivers.
+func (request *Request) Publish(data []byte) error {
+	if len(request.Agent) > 0 {
+		return ErrAgentUnsupported
+	}
+	if _, err := protocol.ParseSigned(data); err != nil {
+		return err
+	}
+	conn, err := request.connect()
+	if err != nil {
 		return err
 	}
-	return conn.Flush()
+	request.conn = conn
+	return request.publish(conn, mkSubject(request.Config.Subject, request.Subject), data)
 }
 
-func (request *Request) SendRequest(handler ReplyHandlerFunc, dest, verb, msg string, uuid ...string) error {
-	var ctx context.Context
+// SendAck sends a message like Send and waits until all potential receivers have
+// acknowledged its delivery or ackTimeout expires. It does not wait for the message
+// to be handled. It returns the potential receivers that did not acknowledge.
+func (request *Request) SendAck(ackTimeout time.Duration, dest, verb, msg string, uuid ...string) (protocol.Peers, error) {
 	if dest == "" {
 		dest = "**"
 	}
-	potentialReceivers := request.Config.PotentialReceivers(dest)
+	if len(request.Agent) > 0 {
+		return request.agentSendAck(ackTimeout, dest, verb, msg, uuid...)
+	}
+	potentialReceivers := request.PotentialReceivers(dest, verb)
 	if len(potentialReceivers) == 0 {
-		return ErrNoReceivers
+		return nil, ErrNoReceivers
+	}
+	ctx, done := request.newContext(ackTimeout)
+	defer done()
+	conn, err := request.connect()
+	if err != nil {
+		return potentialReceivers, err
+	}
+	request.conn = conn
+	msgStr := &protocol.Message{
+		SenderPublicKey: request.SenderPublicKey,
+		Destination:     dest,
+		Selector:        request.Selector,
+		UUID:            exuuid(uuid...),
+		Verb:            verb,
+		Payload:         msg,
+		Encrypted:       request.Encrypt,
+		Ack:             true,
 	}
-	ctx, request.done = context.WithCancel(context.Background())
-	if request.Timeout > 0 {
-		ctx, request.done = context.WithTimeout(ctx, request.Timeout)
+	msgOut, err := msgStr.EncodeMessage(request.Config)
+	if err != nil {
+		return potentialReceivers, err
 	}
-	defer request.done()
-	conn, err := connect(request.Config)
+	replySubject := mkSubject(request.Config.Subject, hex.EncodeToString(msgStr.Hash))
+	sub, err := conn.SubscribeSync(replySubject)
 	if err != nil {
-		return err
+		return potentialReceivers, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	subject := mkSubject(request.Config.Subject, request.Subject)
+	if err := request.publish(conn, subject, msgOut); err != nil {
+		return potentialReceivers, err
+	}
+	ignore := func(ctx context.Context, message *protocol.Message) {}
+	return request.receiveReplies(ctx, ignore, sub, potentialReceivers)
+}
+
+// SendRequest sends a message that requests a reply and calls handler for every reply received
+// until all potential receivers have sent their final reply or the timeout expires. It returns the potential
+// receivers that did not reply and, with OnlineOnly, the ones that were not waited for because they are offline.
+func (request *Request) SendRequest(handler ReplyHandlerFunc, dest, verb, msg string, uuid ...string) (missing, offline protocol.Peers, err error) {
+	if dest == "" {
+		dest = "**"
+	}
+	if len(request.Agent) > 0 {
+		return request.agentSendRequest(handler, dest, verb, msg, uuid...)
+	}
+	potentialReceivers := request.PotentialReceivers(dest, verb)
+	if len(potentialReceivers) == 0 {
+		return nil, nil, ErrNoReceivers
+	}
+	ctx, done := request.newContext(request.Timeout)
+	defer done()
+	conn, err := request.connect()
+	if err != nil {
+		return potentialReceivers, nil, err
 	}
 	request.conn = conn
+	if request.OnlineOnly {
+		var online protocol.Peers
+		if online, offline, err = request.onlineReceivers(conn, potentialReceivers); err != nil {
+			return potentialReceivers, nil, err
+		}
+		if len(online) == 0 {
+			return nil, offline, ErrNoneOnline
+		}
+		potentialReceivers = online
+	}
 	msgStr := &protocol.Message{
 		SenderPublicKey: request.SenderPublicKey,
 		Destination:     dest,
+		Selector:        request.Selector,
 		RequestReply:    true,
 		UUID:            exuuid(uuid...),
 		Verb:            verb,
 		Payload:         msg,
+		Encrypted:       request.Encrypt,
+		Follow:          request.Follow,
 	}
 	msgOut, err := msgStr.EncodeMessage(request.Config)
 	if err != nil {
-		return err
+		return potentialReceivers, offline, err
 	}
 	replySubject := mkSubject(request.Config.Subject, hex.EncodeToString(msgStr.Hash))
 	sub, err := conn.SubscribeSync(replySubject)
 	if err != nil {
-		return err
+		return potentialReceivers, offline, err
 	}
 	defer func() { _ = sub.Unsubscribe() }()
 
 	subject := mkSubject(request.Config.Subject, request.Subject)
-	if err := conn.Publish(subject, msgOut); err != nil {
-		return err
+	if err := request.publish(conn, subject, msgOut); err != nil {
+		return potentialReceivers, offline, err
 	}
-	if err := conn.Flush(); err != nil {
-		return err
+	missing, err = request.receiveReplies(ctx, handler, sub, potentialReceivers)
+	if err == nil && len(missing) > 0 && (request.isCancelled() || (request.CancelOnTimeout && ctx.Err() == context.DeadlineExceeded)) {
+		missing, err = request.cancelRequest(conn, handler, sub, msgStr, missing)
 	}
-	return request.receiveReplies(ctx, handler, sub, potentialReceivers)
+	return missing, offline, err
 }
 
-func (request *Request) receiveReplies(ctx context.Context, handler ReplyHandlerFunc, sub *nats.Subscription, receivers protocol.Peers) error {
+func (request *Request) receiveReplies(ctx context.Context, handler ReplyHandlerFunc, sub *nats.Subscription, receivers protocol.Peers) (protocol.Peers, error) {
 	for {
 		msg, err := sub.NextMsgWithContext(ctx)
 		if err == context.DeadlineExceeded || err == context.Canceled {
-			return nil
+			return receivers, nil
 		}
 		if msg != nil {
 			msgStr, err := protocol.DecodeReply(request.Config, msg.Data)
@@ -159,10 +316,17 @@ func (request *Request) receiveReplies(ctx context.Context, handler ReplyHandler
 			if msgStr.RequestReply {
 				continue
 			}
-			receivers = receivers.Remove(msgStr.SenderPublicKey)
+			if request.Encrypt && !msgStr.Encrypted {
+				log.Printf("Message error: %s", protocol.ErrNotEncrypted)
+				continue
+			}
+			// A responder that streams its output is finished with its final reply.
+			if !protocol.ParseReply(msgStr.Payload).Partial {
+				receivers = receivers.Remove(msgStr.SenderPublicKey)
+			}
 			handler(ctx, msgStr)
 			if len(receivers) == 0 {
-				return nil
+				return receivers, nil
 			}
 		}
 	}
@@ -83,11 +83,11 @@ func TestRequest_SendRequest(t *testing.T) {
 
 		if reply != nil {
 			resp := new(protocol.Message) // &protocol.Message{Payload: "this is a reply"}
-			op, err := subprocess.Exec(ctx, rec.Config, []string{"../../tests/test.sh"}, message)
+			op, err := subprocess.Exec(ctx, rec.Config, &protocol.Handler{Command: []string{"../../tests/test.sh"}}, message)
 			if err != nil {
 				log.Printf("Exec: %s", err)
 			}
-			resp.Payload = op
+			resp.Payload = op.Encode()
 			if err := reply(resp); err != nil {
 				log.Printf("Reply error: %s\n", err)
 			}
@@ -104,7 +104,7 @@ func TestRequest_SendRequest(t *testing.T) {
 		}
 	}()
 	time.Sleep(time.Second / 2)
-	if err := req.SendRequest(replyHandler, "net.crypto.internal.**", "update", "12345", ""); err != nil {
+	if _, _, err := req.SendRequest(replyHandler, "net.crypto.internal.**", "update", "12345", ""); err != nil {
 		t.Fatalf("Send: %s", err)
 	}
 	<-c
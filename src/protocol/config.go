@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,11 +17,21 @@ const (
 	defaultCredsFile   = "/path/to/credentials/file"
 	defaultSubject     = "remaphore"
 	defaultDestination = "all"
+	defaultStream      = "remaphore"
 	AllowedClockSkew   = time.Second * 5
+	MaxReplayAge       = time.Hour
+)
+
+// Policies of the worker pool when all workers are busy and the queue is full.
+const (
+	PolicyQueue  = "queue"  // Wait until the message can be queued.
+	PolicyDrop   = "drop"   // Drop the newest message.
+	PolicyReject = "reject" // Drop the newest message and reply with StatusBusy.
 )
 
 type Peers []Peer
 type Identities []Identity
+type Users []User
 
 type Config struct {
 	NATSUrl          []string
@@ -29,8 +40,22 @@ type Config struct {
 	DefaultKey       Base58Bytes
 	Destination      string
 	AllowedClockSkew time.Duration
+	Stream           string
+	MaxReplayAge     time.Duration
+	MaxValidity      time.Duration // Longest validity of messages accepted beyond the clock skew.
+	EncryptedVerbs   []string
+	Labels           Labels         // Labels of this node that messages can select it by.
+	Workers          int            // Number of messages handled concurrently. Handled one by one if 0.
+	WorkerQueue      int            // Number of messages waiting for a worker.
+	WorkerPolicy     string         // PolicyQueue, PolicyDrop or PolicyReject.
+	WorkerLimits     map[string]int // Maximum number of concurrently handled messages per verb.
+	Roles            Roles          // Named permission lists referred to with "@name".
+	Windows          Windows        // Named time windows referred to with "~name".
+	Quorums          Quorums        // Numbers of signers required for verbs.
 	Identities       Identities
 	Peers            Peers
+	Users            Users
+	Handlers         Handlers
 }
 
 func (config *Config) String() string {
@@ -43,6 +68,46 @@ func (config *Config) String() string {
 	lines = append(lines, fmt.Sprintf("default_identity: %s", base58.Encode(config.DefaultKey)))
 	lines = append(lines, fmt.Sprintf("destination: %s", config.Destination))
 	lines = append(lines, fmt.Sprintf("allow_skew: %v", config.AllowedClockSkew))
+	lines = append(lines, fmt.Sprintf("stream: %s", config.Stream))
+	lines = append(lines, fmt.Sprintf("max_replay_age: %v", config.MaxReplayAge))
+	if config.MaxValidity > 0 {
+		lines = append(lines, fmt.Sprintf("max_validity: %v", config.MaxValidity))
+	}
+	if len(config.EncryptedVerbs) > 0 {
+		lines = append(lines, fmt.Sprintf("require_encryption: %s", strings.Join(config.EncryptedVerbs, ", ")))
+	}
+	if len(config.Labels) > 0 {
+		lines = append(lines, fmt.Sprintf("labels: %s", config.Labels))
+	}
+	if config.Workers > 0 {
+		lines = append(lines, fmt.Sprintf("workers: %d", config.Workers))
+		lines = append(lines, fmt.Sprintf("worker_queue: %d", config.WorkerQueue))
+		lines = append(lines, fmt.Sprintf("worker_policy: %s", config.WorkerPolicy))
+		if len(config.WorkerLimits) > 0 {
+			limits := make([]string, 0, len(config.WorkerLimits))
+			for verb, limit := range config.WorkerLimits {
+				limits = append(limits, fmt.Sprintf("%s=%d", verb, limit))
+			}
+			sort.Strings(limits)
+			lines = append(lines, fmt.Sprintf("worker_limit: %s", strings.Join(limits, ", ")))
+		}
+	}
+	if len(config.Roles) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprint("[ Roles ]"))
+		for _, name := range config.Roles.Names() {
+			lines = append(lines, fmt.Sprintf("%s [%s]", name, strings.Join(config.Roles[name], ", ")))
+		}
+	}
+	if len(config.Windows) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprint("[ Windows ]"))
+		for _, name := range config.Windows.Names() {
+			for _, w := range config.Windows[name] {
+				lines = append(lines, fmt.Sprintf("%s %s", name, w))
+			}
+		}
+	}
 	lines = append(lines, "")
 	lines = append(lines, fmt.Sprint("[ Identities ]"))
 	for _, i := range config.Identities {
@@ -53,27 +118,124 @@ func (config *Config) String() string {
 	for _, i := range config.Peers {
 		lines = append(lines, i.String())
 	}
+	if len(config.Quorums) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprint("[ Quorum ]"))
+		for _, q := range config.Quorums {
+			lines = append(lines, q.String())
+		}
+	}
+	if len(config.Users) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprint("[ Users ]"))
+		for _, i := range config.Users {
+			lines = append(lines, i.String())
+		}
+	}
+	if len(config.Handlers) > 0 {
+		lines = append(lines, "")
+		lines = append(lines, fmt.Sprint("[ Handlers ]"))
+		for _, i := range config.Handlers {
+			lines = append(lines, i.String())
+		}
+	}
 	return strings.Join(lines, "\n")
 }
 
 type Identity struct {
 	PublicKey   Base58Bytes
 	PrivateKey  Base58Bytes
-	Permissions []string
+	Permissions []string // Permissions with roles expanded.
+	Declared    []string // Permissions as configured if they refer to roles, else nil.
 }
 
 func (identity *Identity) String() string {
-	return fmt.Sprintf("%s %s [%s]", base58.Encode(identity.PublicKey), base58.Encode(identity.PrivateKey), strings.Join(identity.Permissions, ", "))
+	return fmt.Sprintf("%s %s [%s]", base58.Encode(identity.PublicKey), base58.Encode(identity.PrivateKey), declaredPermissions(identity.Permissions, identity.Declared))
 }
 
 type Peer struct {
 	PublicKey   Base58Bytes
 	Destination string
-	Permissions []string
+	Permissions []string // Permissions with roles expanded.
+	Declared    []string // Permissions as configured if they refer to roles, else nil.
+	Labels      Labels   // Labels the peer declares in its config, used to select potential receivers.
 }
 
 func (peer *Peer) String() string {
-	return fmt.Sprintf("%s %s [%s]", peer.Destination, base58.Encode(peer.PublicKey), strings.Join(peer.Permissions, ", "))
+	ret := fmt.Sprintf("%s %s [%s]", peer.Destination, base58.Encode(peer.PublicKey), declaredPermissions(peer.Permissions, peer.Declared))
+	if len(peer.Labels) > 0 {
+		ret += fmt.Sprintf(" {%s}", peer.Labels)
+	}
+	return ret
+}
+
+// User maps a local unix user to an identity it may use through the agent.
+type User struct {
+	Name        string // User name or numeric uid.
+	PublicKey   Base58Bytes
+	Permissions []string // Permissions with roles expanded.
+	Declared    []string // Permissions as configured if they refer to roles, else nil.
+}
+
+func (user *User) String() string {
+	return fmt.Sprintf("%s %s [%s]", user.Name, base58.Encode(user.PublicKey), declaredPermissions(user.Permissions, user.Declared))
+}
+
+func (user *User) HasPermission(verb ...string) bool {
+	return testPermission(user.Permissions, verb...)
+}
+
+func (user *User) is(names ...string) bool {
+	for _, n := range names {
+		if user.Name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Permitted returns true if one of the names of a user may use the identity publicKey for verb.
+func (users Users) Permitted(names []string, publicKey []byte, verb ...string) bool {
+	for _, u := range users {
+		if u.is(names...) && bytes.Equal(u.PublicKey, publicKey) && u.HasPermission(verb...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys returns the identities that one of the names of a user may use for verb.
+func (users Users) Keys(names []string, verb ...string) []Base58Bytes {
+	ret := make([]Base58Bytes, 0, 1)
+	for _, u := range users {
+		if u.is(names...) && u.HasPermission(verb...) {
+			ret = append(ret, u.PublicKey)
+		}
+	}
+	return ret
+}
+
+// Public returns a copy of the config for the given user names that contains neither private keys,
+// nor identities the user may not use, nor the user table.
+func (config *Config) Public(names []string) *Config {
+	ret := *config
+	ret.Identities = make(Identities, 0, len(config.Identities))
+	for _, i := range config.Identities {
+		if !config.Users.Permitted(names, i.PublicKey) {
+			continue
+		}
+		i.PrivateKey = nil
+		ret.Identities = append(ret.Identities, i)
+	}
+	if !config.Users.Permitted(names, config.DefaultKey) {
+		ret.DefaultKey = nil
+		if len(ret.Identities) > 0 {
+			ret.DefaultKey = ret.Identities[0].PublicKey
+		}
+	}
+	ret.Users = nil
+	ret.Handlers = nil
+	return &ret
 }
 
 func NewConfig() *Config {
@@ -86,6 +248,8 @@ func NewConfig() *Config {
 		NATSCredsFile:    defaultCredsFile,
 		Subject:          defaultSubject,
 		AllowedClockSkew: AllowedClockSkew,
+		Stream:           defaultStream,
+		MaxReplayAge:     MaxReplayAge,
 		DefaultKey:       Base58Bytes(publicKey),
 		Destination:      defaultDestination,
 		Identities: Identities{{
@@ -124,6 +288,24 @@ func (config *Config) PrivateKey(publicKey []byte, verb ...string) []byte {
 	return nil
 }
 
+// PrivateKeyAt is PrivateKey for messages sent to destination now. It also considers
+// permissions scoped to destination patterns and restricted to time windows.
+func (config *Config) PrivateKeyAt(publicKey []byte, verb, destination string) []byte {
+	if publicKey == nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil
+	}
+	ctx := config.permissionContext(destination, time.Now())
+	for _, v := range config.Identities {
+		if bytes.Equal(v.PublicKey, publicKey) {
+			if evalPermission(v.Permissions, verb, ctx, nil) {
+				return v.PrivateKey
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
 func (peers Peers) Known(publicKey []byte, verb ...string) bool {
 	if publicKey == nil || len(publicKey) != ed25519.PublicKeySize {
 		return false
@@ -136,36 +318,129 @@ func (peers Peers) Known(publicKey []byte, verb ...string) bool {
 	return false
 }
 
-func (config *Config) PotentialReceivers(destination string) Peers {
+// KnownAt is Known for messages sent to destination. It also considers permissions
+// scoped to destination patterns.
+func (peers Peers) KnownAt(publicKey []byte, verb, destination string) bool {
+	if publicKey == nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	for _, v := range peers {
+		if bytes.Equal(v.PublicKey, publicKey) {
+			return v.HasPermissionAt(verb, destination)
+		}
+	}
+	return false
+}
+
+// verifyPeerPermission checks the permissions of the signer publicKey for msg. Windowed
+// entries apply if both the send time and the local clock are within their windows.
+func (config *Config) verifyPeerPermission(publicKey []byte, msg *Message) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return ErrPeerPermission
+	}
+	for _, peer := range config.Peers {
+		if !bytes.Equal(peer.PublicKey, publicKey) {
+			continue
+		}
+		ctx := config.permissionContext(msg.Destination, time.Unix(0, msg.SendTimeNano), time.Now())
+		if evalPermission(peer.Permissions, msg.PermissionVerb(), ctx, nil) {
+			return nil
+		}
+		if ctx.trace(peer.Permissions, msg.PermissionVerb()).OutOfWindow() {
+			return ErrPermissionWindow
+		}
+		return ErrPeerPermission
+	}
+	return ErrPeerPermission
+}
+
+// permissionContext returns the context to evaluate permissions for messages sent to
+// destination at times.
+func (config *Config) permissionContext(destination string, times ...time.Time) *permissionContext {
+	return &permissionContext{destination: destination, times: times, windows: config.Windows}
+}
+
+// TracePermission returns how permissions decide about verb sent to destination, if not
+// empty, at times. Without times windowed entries that allow verbs do not apply.
+func (config *Config) TracePermission(permissions []string, verb, destination string, times ...time.Time) *PermissionTrace {
+	return config.permissionContext(destination, times...).trace(permissions, verb)
+}
+
+// EffectivePermissions returns the entries of permissions that are in effect at t,
+// leaving out windowed entries outside of their windows.
+func (config *Config) EffectivePermissions(permissions []string, t time.Time) []string {
+	ret := make([]string, 0, len(permissions))
+	ctx := config.permissionContext("", t)
+	for _, entry := range permissions {
+		if p := compilePermission(entry); p != nil && p.inWindow(ctx) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// PotentialReceivers returns the peers that match the destination pattern and the
+// labels of which fulfil selector, if given.
+func (config *Config) PotentialReceivers(destination string, selector ...Selector) Peers {
 	ret := make(Peers, 0, len(config.Peers))
+	pattern, err := CompilePattern(destination)
+	if err != nil {
+		return ret
+	}
 	for _, rec := range config.Peers {
-		if MatchWildcards(rec.Destination, destination) {
+		if pattern.Match(rec.Destination) && matchSelectors(rec.Labels, selector) {
 			ret = append(ret, *rec.Copy())
 		}
 	}
 	return ret
 }
 
-func testPermission(permissions []string, verb ...string) bool {
-	if verb == nil || len(verb) == 0 {
-		return true
+// PotentialReceiversFor is PotentialReceivers for messages of verb sent by the identity
+// publicKey. Peers outside the scopes of the identity's permissions for verb are not
+// included, as they refuse the message when they grant the same permissions.
+func (config *Config) PotentialReceiversFor(publicKey []byte, verb, destination string, selector ...Selector) Peers {
+	receivers := config.PotentialReceivers(destination, selector...)
+	var permissions []string
+	for _, i := range config.Identities {
+		if bytes.Equal(i.PublicKey, publicKey) {
+			permissions = i.Permissions
+		}
 	}
-	tVerb := verb[0]
-	for _, v := range permissions {
-		if v == "*" {
-			return true
+	if permissions == nil {
+		return receivers
+	}
+	ret := receivers[:0]
+	for _, rec := range receivers {
+		if evalPermission(permissions, verb, config.permissionContext(rec.Destination, time.Now()), nil) {
+			ret = append(ret, rec)
 		}
-		if tVerb == v {
-			return true
+	}
+	return ret
+}
+
+func matchSelectors(labels Labels, selectors []Selector) bool {
+	for _, s := range selectors {
+		if !s.Matches(labels) {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
 func (identity *Identity) HasPermission(verb ...string) bool {
 	return testPermission(identity.Permissions, verb...)
 }
 
+// HasPermissionAt returns true if the identity may send verb to destination.
+func (identity *Identity) HasPermissionAt(verb, destination string) bool {
+	return testPermissionAt(identity.Permissions, verb, destination)
+}
+
+// TracePermission returns how the permissions of the identity decide about verb sent to destination, if given.
+func (identity *Identity) TracePermission(verb string, destination ...string) *PermissionTrace {
+	return TracePermission(identity.Permissions, verb, destination...)
+}
+
 func (identity *Identity) Peer(destination string) *Peer {
 	return &Peer{
 		PublicKey:   identity.PublicKey,
@@ -191,6 +466,8 @@ func (peer *Peer) Copy() *Peer {
 		PublicKey:   copySlice(peer.PublicKey),
 		Destination: peer.Destination,
 		Permissions: copyStringSlice(peer.Permissions),
+		Declared:    peer.Declared,
+		Labels:      peer.Labels,
 	}
 }
 
@@ -198,6 +475,16 @@ func (peer *Peer) HasPermission(verb ...string) bool {
 	return testPermission(peer.Permissions, verb...)
 }
 
+// HasPermissionAt returns true if the peer may send verb to destination.
+func (peer *Peer) HasPermissionAt(verb, destination string) bool {
+	return testPermissionAt(peer.Permissions, verb, destination)
+}
+
+// TracePermission returns how the permissions of the peer decide about verb sent to destination, if given.
+func (peer *Peer) TracePermission(verb string, destination ...string) *PermissionTrace {
+	return TracePermission(peer.Permissions, verb, destination...)
+}
+
 func (peers Peers) Remove(peer []byte) Peers {
 	for i, p := range peers {
 		if bytes.Equal(p.PublicKey, peer) {
@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+var (
+	ErrQuorum   = errors.New("not enough signatures of permitted peers")
+	ErrCosigned = errors.New("message already signed by key")
+)
+
+// signerSep separates the public keys and the signatures of several signers on the wire.
+const signerSep = "+"
+
+// Cosignature is the signature of the pre-message by a signer other than the sender.
+type Cosignature struct {
+	PublicKey Base58Bytes
+	Signature Base58Bytes
+}
+
+// Quorum requires messages of the verbs matching Verb to be signed by at least Signers
+// distinct peers that have permission for the message.
+type Quorum struct {
+	Verb    string
+	Signers int
+}
+
+func (quorum *Quorum) String() string {
+	return fmt.Sprintf("%s %d", quorum.Verb, quorum.Signers)
+}
+
+type Quorums []Quorum
+
+// ValidQuorumVerb returns an error if verb cannot be used as the verb pattern of a quorum.
+func ValidQuorumVerb(verb string) error {
+	if strings.ContainsAny(verb, denyPrefix+scopeSep+windowSep) || compilePermission(verb) == nil {
+		return fmt.Errorf("bad quorum verb: \"%s\"", verb)
+	}
+	return nil
+}
+
+// Signers returns the number of signers required for verb. If several quorums match,
+// the largest applies.
+func (quorums Quorums) Signers(verb string) int {
+	ret := 1
+	for _, q := range quorums {
+		if p := compilePermission(q.Verb); p != nil && p.verb.Match(verb) && q.Signers > ret {
+			ret = q.Signers
+		}
+	}
+	return ret
+}
+
+// Signers returns the public keys of the sender and the cosigners.
+func (msg *Message) Signers() []Base58Bytes {
+	ret := []Base58Bytes{msg.SenderPublicKey}
+	for _, s := range msg.Cosignatures {
+		ret = append(ret, s.PublicKey)
+	}
+	return ret
+}
+
+// encoded returns the message as transmitted.
+func (msg *Message) encoded() []byte {
+	keys := []string{base58.Encode(msg.SenderPublicKey)}
+	signatures := []string{base58.Encode(msg.SenderSignature)}
+	for _, s := range msg.Cosignatures {
+		keys = append(keys, base58.Encode(s.PublicKey))
+		signatures = append(signatures, base58.Encode(s.Signature))
+	}
+	return bytes.Join([][]byte{
+		[]byte(strings.Join(keys, signerSep)),
+		[]byte(strings.Join(signatures, signerSep)),
+		msg.preMsg(),
+	}, []byte(sepChar))
+}
+
+// Cosign adds the signature of the local identity publicKey, or the default identity,
+// to a message and returns the encoded message. The identity needs permission for the
+// message.
+func (msg *Message) Cosign(c *Config, publicKey []byte) ([]byte, error) {
+	if len(publicKey) == 0 {
+		publicKey = c.DefaultKey
+	}
+	for _, k := range msg.Signers() {
+		if bytes.Equal(k, publicKey) {
+			return nil, ErrCosigned
+		}
+	}
+	privateKey := c.PrivateKeyAt(publicKey, msg.PermissionVerb(), msg.Destination)
+	if privateKey == nil {
+		return nil, ErrNoPrivateKey
+	}
+	msg.Cosignatures = append(msg.Cosignatures, Cosignature{
+		PublicKey: copySlice(publicKey),
+		Signature: ed25519.Sign(ed25519.PrivateKey(privateKey), msg.preMsg()),
+	})
+	ret := msg.encoded()
+	msg.Hash = sha256Hash(ret)
+	return ret, nil
+}
+
+// ParseSigned decodes a message and verifies its signatures, but neither the
+// permissions of the signers nor the send time. Encrypted payloads are not opened.
+func ParseSigned(msg []byte) (*Message, error) {
+	ret, err := parseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(ret.SenderPublicKey) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(ret.SenderPublicKey), ret.preMsg(), ret.SenderSignature) {
+		return ret, ErrSignature
+	}
+	if err := ret.verifyCosignatures(); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// verifyCosignatures checks that all cosignatures are valid and of distinct signers.
+func (msg *Message) verifyCosignatures() error {
+	preMsg := msg.preMsg()
+	signers := msg.Signers()
+	for i, s := range msg.Cosignatures {
+		if len(s.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(s.PublicKey), preMsg, s.Signature) {
+			return ErrSignature
+		}
+		for _, k := range signers[:i+1] {
+			if bytes.Equal(k, s.PublicKey) {
+				return ErrFormat
+			}
+		}
+	}
+	return nil
+}
+
+// verifyQuorum checks the cosignatures of msg and that enough permitted peers signed
+// it. The permission of the sender has already been verified.
+func (config *Config) verifyQuorum(msg *Message, isReply bool) error {
+	if len(msg.Cosignatures) == 0 && (isReply || len(config.Quorums) == 0) {
+		return nil
+	}
+	if isReply {
+		return ErrFormat
+	}
+	if err := msg.verifyCosignatures(); err != nil {
+		return err
+	}
+	if msg.IsCancel() {
+		return nil
+	}
+	required, signers := config.Quorums.Signers(msg.Verb), 1
+	for _, s := range msg.Cosignatures {
+		if config.verifyPeerPermission(s.PublicKey, msg) == nil {
+			signers++
+		}
+	}
+	if signers < required {
+		return ErrQuorum
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage_Cosign(t *testing.T) {
+	alice, bob, eve := NewConfig(), NewConfig(), NewConfig()
+	receiver := NewConfig()
+	receiver.Quorums = Quorums{{Verb: "drop_database", Signers: 2}, {Verb: "db.*", Signers: 3}}
+	for _, c := range []*Config{alice, bob} {
+		c.Identities[0].Permissions = []string{"*"}
+		receiver.Peers = append(receiver.Peers, *c.Identities[0].Peer(c.Destination))
+		receiver.Peers[len(receiver.Peers)-1].Permissions = []string{"ping", "drop_database"}
+	}
+	eve.Identities[0].Permissions = []string{"*"}
+	receiver.Peers = append(receiver.Peers, *eve.Identities[0].Peer(eve.Destination))
+	receiver.Peers[2].Permissions = []string{"ping"}
+	assert.Equal(t, 2, receiver.Quorums.Signers("drop_database"))
+	assert.Equal(t, 3, receiver.Quorums.Signers("db.users"))
+	assert.Equal(t, 1, receiver.Quorums.Signers("ping"))
+
+	msg := &Message{Destination: receiver.Destination, Verb: "drop_database", Payload: "users"}
+	d, err := msg.EncodeMessageAt(alice, time.Now())
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	if _, err := DecodeMessage(receiver, d); err != ErrQuorum {
+		t.Errorf("Single signature: %v", err)
+	}
+	draft, err := ParseSigned(d)
+	if err != nil {
+		t.Fatalf("ParseSigned: %s", err)
+	}
+	if _, err := draft.Cosign(alice, nil); err != ErrCosigned {
+		t.Errorf("Signed twice: %v", err)
+	}
+	withEve, err := draft.Cosign(eve, nil)
+	if err != nil {
+		t.Fatalf("Cosign: %s", err)
+	}
+	if _, err := DecodeMessage(receiver, withEve); err != ErrQuorum {
+		t.Errorf("Cosigned by peer without permission: %v", err)
+	}
+	draft, _ = ParseSigned(d)
+	signed, err := draft.Cosign(bob, nil)
+	if err != nil {
+		t.Fatalf("Cosign: %s", err)
+	}
+	decoded, err := DecodeMessage(receiver, signed)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	assert.Equal(t, "users", decoded.Payload)
+	assert.Len(t, decoded.Signers(), 2)
+	assert.Equal(t, sha256Hash(signed), decoded.Hash)
+
+	tampered := bytes.Replace(signed, []byte(",users"), []byte(",admin"), 1)
+	if _, err := ParseSigned(tampered); err != ErrSignature {
+		t.Errorf("Tampered message: %v", err)
+	}
+	f := bytes.SplitN(d, []byte(","), 3)
+	duplicate := bytes.Join([][]byte{
+		append(append(append([]byte{}, f[0]...), '+'), f[0]...),
+		append(append(append([]byte{}, f[1]...), '+'), f[1]...),
+		f[2],
+	}, []byte(","))
+	if _, err := ParseSigned(duplicate); err != ErrFormat {
+		t.Errorf("Duplicate signer: %v", err)
+	}
+	if _, err := ParseSigned(d[1:]); err == nil {
+		t.Error("Corrupt message accepted")
+	}
+	if _, err := DecodeReply(receiver, signed); err != ErrFormat {
+		t.Errorf("Cosigned reply: %v", err)
+	}
+	ping, err := (&Message{Destination: receiver.Destination, Verb: "ping"}).EncodeMessage(alice)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	if _, err := DecodeMessage(receiver, ping); err != nil {
+		t.Errorf("Verb without quorum: %s", err)
+	}
+}
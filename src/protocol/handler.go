@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+type Handlers []Handler
+
+// Delivery modes of the message to the command.
+const (
+	DeliveryArgv  = "argv"  // Verb and payload are appended to the arguments and REMAPHORE_MSG contains the payload.
+	DeliveryStdin = "stdin" // The payload is written to stdin.
+	DeliveryFile  = "file"  // The message is written as JSON to the file named by REMAPHORE_MSG_FILE.
+)
+
+// ValidDelivery returns true if mode is a delivery mode. The empty mode means DeliveryArgv.
+func ValidDelivery(mode string) bool {
+	switch mode {
+	case "", DeliveryArgv, DeliveryStdin, DeliveryFile:
+		return true
+	}
+	return false
+}
+
+// Handler maps messages to a command that is executed for them.
+type Handler struct {
+	Verb        string
+	Destination string      // Pattern that the local destination must match, if set.
+	Sender      Base58Bytes // Only match messages of this sender, if set.
+	Command     []string
+	Dir         string        // Working directory of the command.
+	Timeout     time.Duration // Maximum runtime of the command, if set.
+	User        string        // User to run the command as, if set.
+	Delivery    string        // How the message is passed to the command. DeliveryArgv if empty.
+	OutputLimit int           // Maximum bytes of output captured. DefaultOutputLimit if 0.
+
+	// Restrictions applied to the command before exec. Unset if zero.
+	Group        string        // Primary group. The user's primary group if empty.
+	Groups       []string      // Supplementary groups. The user's groups if empty.
+	Umask        string        // Octal umask.
+	RlimitCPU    time.Duration // CPU time limit.
+	RlimitMemory uint64        // Address space limit in bytes.
+	RlimitNofile uint64        // Open files limit.
+	NoNewPrivs   bool          // Prevent gaining privileges, e.g. through setuid binaries.
+}
+
+func (handler *Handler) String() string {
+	f := []string{handler.Verb}
+	if len(handler.Destination) > 0 {
+		f = append(f, "dest="+handler.Destination)
+	}
+	if len(handler.Sender) > 0 {
+		f = append(f, "sender="+base58.Encode(handler.Sender))
+	}
+	if len(handler.Dir) > 0 {
+		f = append(f, "dir="+handler.Dir)
+	}
+	if handler.Timeout > 0 {
+		f = append(f, fmt.Sprintf("timeout=%v", handler.Timeout))
+	}
+	if len(handler.User) > 0 {
+		f = append(f, "user="+handler.User)
+	}
+	if len(handler.Group) > 0 {
+		f = append(f, "group="+handler.Group)
+	}
+	if len(handler.Groups) > 0 {
+		f = append(f, "groups="+strings.Join(handler.Groups, ","))
+	}
+	if len(handler.Umask) > 0 {
+		f = append(f, "umask="+handler.Umask)
+	}
+	if handler.RlimitCPU > 0 {
+		f = append(f, fmt.Sprintf("rlimit_cpu=%v", handler.RlimitCPU))
+	}
+	if handler.RlimitMemory > 0 {
+		f = append(f, fmt.Sprintf("rlimit_memory=%d", handler.RlimitMemory))
+	}
+	if handler.RlimitNofile > 0 {
+		f = append(f, fmt.Sprintf("rlimit_nofile=%d", handler.RlimitNofile))
+	}
+	if handler.NoNewPrivs {
+		f = append(f, "no_new_privs=true")
+	}
+	if len(handler.Delivery) > 0 {
+		f = append(f, "delivery="+handler.Delivery)
+	}
+	if handler.OutputLimit > 0 {
+		f = append(f, fmt.Sprintf("output_limit=%d", handler.OutputLimit))
+	}
+	return strings.Join(append(f, handler.Command...), " ")
+}
+
+// Matches returns the filters a message has to pass for the handler.
+func (handler *Handler) Matches() []MsgMatch {
+	ret := []MsgMatch{
+		MatchVerb(handler.Verb),
+		MatchDestination(),
+		MatchLabels(),
+	}
+	if len(handler.Destination) > 0 {
+		ret = append(ret, func(c *Config, m *Message) bool {
+			return MatchWildcards(c.Destination, handler.Destination)
+		})
+	}
+	if len(handler.Sender) > 0 {
+		ret = append(ret, MatchSenderPublicKey(handler.Sender))
+	}
+	return ret
+}
+
+// Find returns the first handler that matches the message, or nil.
+func (handlers Handlers) Find(c *Config, msg *Message) *Handler {
+	for i := range handlers {
+		if msg.Match(c, handlers[i].Matches()...) {
+			return &handlers[i]
+		}
+	}
+	return nil
+}
+
+// Verbs returns the verbs handled.
+func (handlers Handlers) Verbs() []string {
+	ret := make([]string, 0, len(handlers))
+	seen := make(map[string]bool, len(handlers))
+	for _, h := range handlers {
+		if !seen[h.Verb] {
+			seen[h.Verb] = true
+			ret = append(ret, h.Verb)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import "testing"
+
+func TestHandlers_Find(t *testing.T) {
+	handlers := Handlers{
+		{Verb: "deploy", Destination: "web*", Command: []string{"/bin/deploy"}},
+		{Verb: "ping", Command: []string{"/bin/echo"}},
+	}
+	for _, c := range []struct {
+		local, verb, dest string
+		found             bool
+	}{
+		{"web1", "deploy", "web1", true},
+		{"web1", "deploy", "**", true},
+		{"web1", "deploy", "{web,db}[1-9]", true},
+		{"db1", "deploy", "**", false},
+		{"db1", "deploy", "db1", false},
+		{"web1", "deploy", "db1", false},
+		{"db1", "ping", "db1", true},
+		{"db1", "ping", "web1", false},
+	} {
+		config := NewConfig()
+		config.Destination = c.local
+		msg := &Message{Verb: c.verb, Destination: c.dest}
+		if h := handlers.Find(config, msg); (h != nil) != c.found {
+			t.Errorf("%s on %s to %s: found %v", c.verb, c.local, c.dest, h != nil)
+		}
+	}
+}
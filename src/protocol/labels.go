@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrSelector = errors.New("destination selector malformed")
+)
+
+// selectorSep separates the destination from the selector on the wire.
+const selectorSep = "?"
+
+var labelToken = regexp.MustCompile(`^[-_./a-zA-Z0-9]+$`)
+
+// Labels are key=value properties of a node that messages can select it by.
+type Labels map[string]string
+
+// ParseLabels parses "key=value, key=value...".
+func ParseLabels(s string) (Labels, error) {
+	ret := make(Labels)
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); len(l) == 0 {
+			continue
+		}
+		p := strings.Index(l, "=")
+		if p <= 0 {
+			return nil, fmt.Errorf("bad label: \"%s\"", l)
+		}
+		key, value := strings.TrimSpace(l[:p]), strings.TrimSpace(l[p+1:])
+		if !labelToken.MatchString(key) || !labelToken.MatchString(value) {
+			return nil, fmt.Errorf("bad label: \"%s\"", l)
+		}
+		ret[key] = value
+	}
+	return ret, nil
+}
+
+func (labels Labels) String() string {
+	f := make([]string, 0, len(labels))
+	for k, v := range labels {
+		f = append(f, k+"="+v)
+	}
+	sort.Strings(f)
+	return strings.Join(f, ", ")
+}
+
+// Requirement is one term of a selector.
+type Requirement struct {
+	Key    string
+	Value  string
+	Negate bool // The label must not have Value. Nodes without the label match.
+}
+
+func (r Requirement) String() string {
+	if r.Negate {
+		return r.Key + "!=" + r.Value
+	}
+	return r.Key + "=" + r.Value
+}
+
+// Matches returns true if labels fulfil the requirement.
+func (r Requirement) Matches(labels Labels) bool {
+	v, ok := labels[r.Key]
+	if r.Negate {
+		return !ok || v != r.Value
+	}
+	return ok && v == r.Value
+}
+
+// Selector selects nodes by their labels. All requirements must match. The empty selector matches all nodes.
+type Selector []Requirement
+
+// ParseSelector parses "key=value,key!=value...".
+func ParseSelector(s string) (Selector, error) {
+	var ret Selector
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); len(t) == 0 {
+			continue
+		}
+		var r Requirement
+		p := strings.Index(t, "=")
+		if p <= 0 {
+			return nil, fmt.Errorf("bad selector: \"%s\"", t)
+		}
+		r.Key, r.Value = t[:p], t[p+1:]
+		if strings.HasSuffix(r.Key, "!") {
+			r.Key, r.Negate = r.Key[:len(r.Key)-1], true
+		}
+		if !labelToken.MatchString(r.Key) || !labelToken.MatchString(r.Value) {
+			return nil, fmt.Errorf("bad selector: \"%s\"", t)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func (selector Selector) String() string {
+	f := make([]string, len(selector))
+	for i, r := range selector {
+		f[i] = r.String()
+	}
+	return strings.Join(f, ",")
+}
+
+// Matches returns true if labels fulfil all requirements.
+func (selector Selector) Matches(labels Labels) bool {
+	for _, r := range selector {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// escapedSep replaces the field separator in transmitted destination patterns.
+const escapedSep = "%2C"
+
+// destinationField returns the destination with the selector as transmitted.
+// Receivers without selector or pattern list support do not match such destinations.
+func destinationField(destination string, selector Selector) string {
+	destination = strings.ReplaceAll(destination, sepChar, escapedSep)
+	if len(selector) == 0 {
+		return destination
+	}
+	return destination + selectorSep + strings.ReplaceAll(selector.String(), ",", "&")
+}
+
+// splitDestinationField splits a transmitted destination into destination and selector.
+func splitDestinationField(field string) (string, Selector, error) {
+	var selector Selector
+	if p := strings.Index(field, selectorSep); p >= 0 {
+		var err error
+		selector, err = ParseSelector(strings.ReplaceAll(field[p+1:], "&", ","))
+		if err != nil || len(selector) == 0 {
+			return "", nil, ErrSelector
+		}
+		field = field[:p]
+	}
+	return strings.ReplaceAll(field, escapedSep, sepChar), selector, nil
+}
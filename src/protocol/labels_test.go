@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelector_Matches(t *testing.T) {
+	labels := Labels{"role": "db", "env": "prod"}
+	for s, match := range map[string]bool{
+		"":                       true,
+		"role=db":                true,
+		"role=db,env!=staging":   true,
+		"role=db, env=prod":      true,
+		"role=web":               false,
+		"role=db,env!=prod":      false,
+		"version!=2":             true,
+		"version=2":              false,
+		"role=db,env=prod,dc=eu": false,
+	} {
+		selector, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("ParseSelector(%q): %s", s, err)
+			continue
+		}
+		if selector.Matches(labels) != match {
+			t.Errorf("%q matches %v: %v", s, labels, !match)
+		}
+	}
+	for _, s := range []string{"role", "=db", "role!db", "role=d b", "role=db&x=y", "role=db?"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("ParseSelector(%q) accepted", s)
+		}
+	}
+}
+
+func TestMessage_Selector(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	peer2.Labels = Labels{"role": "db", "env": "prod"}
+	selector, _ := ParseSelector("role=db,env!=staging")
+	msg := &Message{
+		Destination: "**",
+		Selector:    selector,
+		Verb:        "ping",
+	}
+	d, err := msg.EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	msg2, err := DecodeMessage(peer2, d)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	assert.Equal(t, msg, msg2)
+	if !msg2.Match(peer2, MatchDestination(), MatchLabels()) {
+		t.Error("Selected receiver does not match")
+	}
+	peer2.Labels["env"] = "staging"
+	if msg2.Match(peer2, MatchLabels()) {
+		t.Error("Excluded receiver matches")
+	}
+	if _, err := (&Message{Destination: "a?b=c", Verb: "ping"}).EncodeMessage(peer1); err != ErrDestinationBadChar {
+		t.Errorf("Selector in destination: %v", err)
+	}
+}
+
+func TestConfig_PotentialReceiversLabels(t *testing.T) {
+	c := NewConfig()
+	c.Peers = Peers{
+		{Destination: "db1", Labels: Labels{"role": "db", "env": "prod"}},
+		{Destination: "db2", Labels: Labels{"role": "db", "env": "staging"}},
+		{Destination: "web1", Labels: Labels{"role": "web"}},
+		{Destination: "other"},
+	}
+	selector, _ := ParseSelector("role=db,env!=staging")
+	receivers := c.PotentialReceivers("**", selector)
+	if len(receivers) != 1 || receivers[0].Destination != "db1" {
+		t.Errorf("Receivers: %v", receivers)
+	}
+	if len(c.PotentialReceivers("**")) != 4 {
+		t.Error("Without selector not all receivers")
+	}
+	selector, _ = ParseSelector("role!=web")
+	assert.Len(t, c.PotentialReceivers("**", selector), 3)
+}
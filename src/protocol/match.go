@@ -32,11 +32,14 @@ func MatchUUID(uuid []byte) MsgMatch {
 	}
 }
 
+// MatchDestination matches messages the destination pattern of which matches the
+// given destination, or the local destination if none is given. A message addressed
+// literally to the given destination matches as well.
 func MatchDestination(destination ...string) MsgMatch {
 	if destination != nil && len(destination) > 0 && len(destination[0]) > 0 {
 		return func(c *Config, m *Message) bool {
 			_ = c
-			return m.Destination == destination[0]
+			return m.Destination == destination[0] || MatchWildcards(destination[0], m.Destination)
 		}
 	}
 	return func(c *Config, m *Message) bool {
@@ -49,3 +52,10 @@ func MatchSenderPublicKey(publicKey []byte) MsgMatch {
 		return bytes.Equal(m.SenderPublicKey, publicKey)
 	}
 }
+
+// MatchLabels matches messages the selector of which the local labels fulfil.
+func MatchLabels() MsgMatch {
+	return func(c *Config, m *Message) bool {
+		return m.Selector.Matches(c.Labels)
+	}
+}
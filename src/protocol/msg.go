@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -21,24 +22,48 @@ var (
 	ErrFormat             = errors.New("message format corrupt")
 	ErrSignature          = errors.New("signature corrupt")
 	ErrPeerPermission     = errors.New("peer key or permission not known")
+	ErrPermissionWindow   = errors.New("peer permission outside of time window")
 	ErrClockSkew          = errors.New("message outside of time window")
+	ErrReplay             = errors.New("message has been seen before")
+	ErrValidity           = errors.New("message validity exceeds max_validity")
 )
 
 const sepChar = ","
 const uuidLen = 12
 
-var requestCode = []byte("Q")
+// CancelPrefix marks the verb of a message that cancels a running request. The verb
+// continues with the verb of the request, the payload is the request's hash in hex.
+// Permission to cancel follows the permission to send the request.
+const CancelPrefix = "cancel:"
+
+const (
+	flagRequestReply = 'Q'
+	flagEncrypted    = 'E'
+	flagFollow       = 'F'
+	flagAck          = 'A'
+	flagValidity     = 'V' // Followed by the validity in seconds in lowercase hex.
+	flagNone         = "_"
+)
 
 type Message struct {
 	SenderPublicKey Base58Bytes
 	SenderSignature Base58Bytes
 	Destination     string
+	Selector        Selector // Labels the receiver must have, in addition to matching Destination.
 	RequestReply    bool
 	SendTimeNano    int64
 	UUID            []byte
 	Verb            string
 	Payload         string
 	Hash            []byte
+	Encrypted       bool          // Payload is encrypted to the recipients.
+	Recipients      []Base58Bytes // Public keys to encrypt for. Defaults to the potential receivers of Destination.
+	Follow          bool          // Requester wants output streamed in partial replies.
+	Ack             bool          // Sender wants an acknowledgement of delivery.
+	Cosignatures    []Cosignature // Signatures of further signers, for verbs that require a quorum.
+	Validity        time.Duration // Time after the send time that the message is accepted, in addition to the clock skew.
+
+	sealed string // Encrypted payload as transmitted.
 }
 
 func RandomBytes(l int) []byte {
@@ -64,18 +89,78 @@ func maxInt64(a, b int64) int64 {
 }
 
 func DecodeMessage(c *Config, msg []byte) (*Message, error) {
-	return decodeMessage(c, msg, false)
+	return decodeMessage(c, msg, false, time.Now())
 }
 
 func DecodeReply(c *Config, msg []byte) (*Message, error) {
-	return decodeMessage(c, msg, true)
+	return decodeMessage(c, msg, true, time.Now())
+}
+
+// DecodeMessageAt decodes a message and checks the clock skew against t instead of the local clock.
+func DecodeMessageAt(c *Config, msg []byte, t time.Time) (*Message, error) {
+	return decodeMessage(c, msg, false, t)
+}
+
+// DecodeReplyAt decodes a reply and checks the clock skew against t instead of the local clock.
+func DecodeReplyAt(c *Config, msg []byte, t time.Time) (*Message, error) {
+	return decodeMessage(c, msg, true, t)
+}
+
+// DecodeStoredMessage decodes a message that the NATS server persisted at storedAt.
+// The clock skew is checked against storedAt instead of the local clock, and the
+// message is only accepted up to MaxReplayAge after it has been stored.
+func DecodeStoredMessage(c *Config, msg []byte, storedAt time.Time) (*Message, error) {
+	ret, err := DecodeMessageAt(c, msg, storedAt)
+	if err != nil {
+		return ret, err
+	}
+	if time.Since(storedAt) > c.MaxReplayAge {
+		return ret, ErrClockSkew
+	}
+	return ret, nil
+}
+
+func decodeMessage(c *Config, msg []byte, isReply bool, now time.Time) (*Message, error) {
+	ret, err := parseMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := ret.verifyPerms(c, isReply); err != nil {
+		return ret, err
+	}
+	if err := c.verifyQuorum(ret, isReply); err != nil {
+		return ret, err
+	}
+	if ret.Validity > c.MaxValidity {
+		return ret, ErrValidity
+	}
+	// Check clockskew
+	if !ret.verifyClockSkew(c, now) {
+		return ret, ErrClockSkew
+	}
+	if !ret.Encrypted {
+		if !isReply && !ret.IsCancel() && testPermission(c.EncryptedVerbs, ret.Verb) {
+			return ret, ErrNotEncrypted
+		}
+		return ret, nil
+	}
+	if ret.Payload, err = open(c, ret.sealed, ret.SenderPublicKey); err != nil {
+		return ret, err
+	}
+	return ret, nil
 }
 
-func decodeMessage(c *Config, msg []byte, isReply bool) (*Message, error) {
+// parseMessage splits an encoded message into its fields without verifying it.
+func parseMessage(msg []byte) (*Message, error) {
 	parts := bytes.SplitN(msg, []byte(sepChar), 3)
 	if len(parts) != 3 {
 		return nil, ErrFormat
 	}
+	keys := strings.Split(string(parts[0]), signerSep)
+	signatures := strings.Split(string(parts[1]), signerSep)
+	if len(keys) != len(signatures) {
+		return nil, ErrFormat
+	}
 	preMsg := parts[2]
 	parts2 := bytes.SplitN(preMsg, []byte(sepChar), 6)
 	if len(parts2) != 6 {
@@ -89,33 +174,80 @@ func decodeMessage(c *Config, msg []byte, isReply bool) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	destination, selector, err := splitDestinationField(string(parts2[0]))
+	if err != nil {
+		return nil, err
+	}
 	ret := &Message{
-		SenderPublicKey: base58.Decode(string(parts[0])),
-		SenderSignature: base58.Decode(string(parts[1])),
-		Destination:     string(parts2[0]),
+		SenderPublicKey: base58.Decode(keys[0]),
+		SenderSignature: base58.Decode(signatures[0]),
+		Destination:     destination,
+		Selector:        selector,
 		SendTimeNano:    sendTimeNano,
 		UUID:            uuid,
 		Verb:            string(parts2[3]),
-		RequestReply:    bytes.Equal(requestCode, parts2[4]),
+		RequestReply:    bytes.IndexByte(parts2[4], flagRequestReply) >= 0,
+		Encrypted:       bytes.IndexByte(parts2[4], flagEncrypted) >= 0,
+		Follow:          bytes.IndexByte(parts2[4], flagFollow) >= 0,
+		Ack:             bytes.IndexByte(parts2[4], flagAck) >= 0,
 		Payload:         string(parts2[5]),
 	}
-	ret.Hash = sha256Hash(msg)
-	if err := ret.verifyPerms(c, isReply); err != nil {
-		return ret, err
+	if ret.Encrypted {
+		ret.sealed, ret.Payload = ret.Payload, ""
 	}
-	// Check clockskew
-	if !ret.verifyClockSkew(c) {
-		return ret, ErrClockSkew
+	if ret.Validity, err = parseValidity(parts2[4]); err != nil {
+		return nil, err
 	}
+	for i := 1; i < len(keys); i++ {
+		ret.Cosignatures = append(ret.Cosignatures, Cosignature{
+			PublicKey: base58.Decode(keys[i]),
+			Signature: base58.Decode(signatures[i]),
+		})
+	}
+	ret.Hash = sha256Hash(msg)
 	return ret, nil
 }
 
-func (msg *Message) verifyClockSkew(c *Config) bool {
-	now := time.Now().UnixNano()
-	if c.AllowedClockSkew < time.Duration(maxInt64(now, msg.SendTimeNano)-minInt64(now, msg.SendTimeNano)) {
+// verifyClockSkew returns true if t is within the clock skew of the send time, or of
+// the validity window that follows it.
+func (msg *Message) verifyClockSkew(c *Config, t time.Time) bool {
+	now := t.UnixNano()
+	if c.AllowedClockSkew < time.Duration(msg.SendTimeNano-now) {
 		return false
 	}
-	return true
+	return time.Duration(now-msg.SendTimeNano) <= msg.Validity+c.AllowedClockSkew
+}
+
+// ValidUntil returns the time after which the message no longer passes the clock skew check.
+func (msg *Message) ValidUntil(c *Config) time.Time {
+	return time.Unix(0, msg.SendTimeNano).Add(msg.Validity + c.AllowedClockSkew)
+}
+
+// replayKey identifies the signed content of a message independent of its encoding.
+func (msg *Message) replayKey() []byte {
+	return sha256Hash(append(copySlice(msg.SenderPublicKey), msg.preMsg()...))
+}
+
+// IsCancel returns true if msg cancels a request.
+func (msg *Message) IsCancel() bool {
+	return strings.HasPrefix(msg.Verb, CancelPrefix)
+}
+
+// PermissionVerb returns the verb that permissions are checked for. It is the verb of
+// the cancelled request for cancel messages.
+func (msg *Message) PermissionVerb() string {
+	return strings.TrimPrefix(msg.Verb, CancelPrefix)
+}
+
+// NewCancel returns a message that cancels request at its receivers.
+func NewCancel(request *Message) *Message {
+	return &Message{
+		SenderPublicKey: request.SenderPublicKey,
+		Destination:     request.Destination,
+		Selector:        request.Selector,
+		Verb:            CancelPrefix + request.Verb,
+		Payload:         hex.EncodeToString(request.Hash),
+	}
 }
 
 func (msg *Message) verifyPerms(c *Config, isReply bool) error {
@@ -126,8 +258,8 @@ func (msg *Message) verifyPerms(c *Config, isReply bool) error {
 		}
 		msg.RequestReply = false
 	} else {
-		if !c.Peers.Known(msg.SenderPublicKey, msg.Verb) {
-			return ErrPeerPermission
+		if err := c.verifyPeerPermission(msg.SenderPublicKey, msg); err != nil {
+			return err
 		}
 	}
 	// Check signature
@@ -137,37 +269,88 @@ func (msg *Message) verifyPerms(c *Config, isReply bool) error {
 	return nil
 }
 
-func (msg *Message) requestReplyField() []byte {
+// parseValidity returns the validity encoded in the flags field.
+func parseValidity(flags []byte) (time.Duration, error) {
+	p := bytes.IndexByte(flags, flagValidity)
+	if p < 0 {
+		return 0, nil
+	}
+	end := p + 1
+	for end < len(flags) && (flags[end] >= '0' && flags[end] <= '9' || flags[end] >= 'a' && flags[end] <= 'f') {
+		end++
+	}
+	seconds, err := strconv.ParseInt(string(flags[p+1:end]), 16, 64)
+	if err != nil || seconds <= 0 || seconds > int64(math.MaxInt64/time.Second) {
+		return 0, ErrFormat
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func (msg *Message) flagsField() []byte {
+	ret := make([]byte, 0, 4)
 	if msg.RequestReply {
-		return requestCode
+		ret = append(ret, flagRequestReply)
+	}
+	if msg.Encrypted {
+		ret = append(ret, flagEncrypted)
+	}
+	if msg.Follow {
+		ret = append(ret, flagFollow)
+	}
+	if msg.Ack {
+		ret = append(ret, flagAck)
+	}
+	if msg.Validity > 0 {
+		seconds := int64((msg.Validity + time.Second - 1) / time.Second)
+		ret = append(append(ret, flagValidity), strconv.FormatInt(seconds, 16)...)
+	}
+	if len(ret) == 0 {
+		return []byte(flagNone)
+	}
+	return ret
+}
+
+func (msg *Message) wirePayload() []byte {
+	if msg.Encrypted {
+		return []byte(msg.sealed)
 	}
-	return []byte("_")
+	return []byte(msg.Payload)
 }
 
 func (msg *Message) preMsg() []byte {
 	return bytes.Join([][]byte{
-		[]byte(msg.Destination),
+		[]byte(destinationField(msg.Destination, msg.Selector)),
 		[]byte(strconv.FormatInt(msg.SendTimeNano, 16)),
 		[]byte(hex.EncodeToString(msg.UUID)),
 		[]byte(msg.Verb),
-		msg.requestReplyField(),
-		[]byte(msg.Payload),
+		msg.flagsField(),
+		msg.wirePayload(),
 	}, []byte(sepChar))
 }
 
 func (msg *Message) EncodeMessage(c *Config) ([]byte, error) {
-	return msg.encode(c, false)
+	return msg.encode(c, false, time.Now())
+}
+
+// EncodeMessageAt encodes a message with send time t instead of the local clock.
+func (msg *Message) EncodeMessageAt(c *Config, t time.Time) ([]byte, error) {
+	return msg.encode(c, false, t)
 }
 
 func (msg *Message) EncodeReply(c *Config) ([]byte, error) {
-	return msg.encode(c, true)
+	return msg.encode(c, true, time.Now())
 }
 
-func (msg *Message) encode(c *Config, isReply bool) ([]byte, error) {
+func (msg *Message) encode(c *Config, isReply bool, t time.Time) ([]byte, error) {
 	var privateKey []byte
-	if strings.Contains(msg.Destination, sepChar) {
+	if strings.Contains(msg.Destination, selectorSep) {
 		return nil, ErrDestinationBadChar
 	}
+	if !isReply {
+		if _, err := CompilePattern(msg.Destination); err != nil {
+			return nil, err
+		}
+	}
 	if strings.Contains(msg.Verb, sepChar) {
 		return nil, ErrVerbBadChar
 	}
@@ -178,22 +361,31 @@ func (msg *Message) encode(c *Config, isReply bool) ([]byte, error) {
 		privateKey = c.PrivateKey(msg.SenderPublicKey)
 		msg.RequestReply = false
 	} else {
-		privateKey = c.PrivateKey(msg.SenderPublicKey, msg.Verb)
+		privateKey = c.PrivateKeyAt(msg.SenderPublicKey, msg.PermissionVerb(), msg.Destination)
 	}
 	if privateKey == nil {
 		return nil, ErrNoPrivateKey
 	}
-	msg.SendTimeNano = time.Now().UnixNano()
+	msg.SendTimeNano = t.UnixNano()
 	//if msg.UUID == nil || len(msg.UUID) == 0 {
 	msg.UUID = NewUUID(msg.UUID)
 	//}
-	preMsg := msg.preMsg()
-	msg.SenderSignature = ed25519.Sign(ed25519.PrivateKey(privateKey), preMsg)
-	encodedMsg := bytes.Join([][]byte{
-		[]byte(base58.Encode(msg.SenderPublicKey)),
-		[]byte(base58.Encode(msg.SenderSignature)),
-		preMsg,
-	}, []byte(sepChar))
+	if msg.Encrypted {
+		recipients := msg.Recipients
+		if len(recipients) == 0 {
+			for _, p := range c.PotentialReceivers(msg.Destination, msg.Selector) {
+				recipients = append(recipients, p.PublicKey)
+			}
+		}
+		sealed, err := seal(msg.Payload, msg.SenderPublicKey, recipients)
+		if err != nil {
+			return nil, err
+		}
+		msg.sealed = sealed
+	}
+	msg.Cosignatures = nil
+	msg.SenderSignature = ed25519.Sign(ed25519.PrivateKey(privateKey), msg.preMsg())
+	encodedMsg := msg.encoded()
 	msg.Hash = sha256Hash(encodedMsg)
 	return encodedMsg, nil
 }
@@ -1,7 +1,9 @@
 package protocol
 
 import (
+	"encoding/hex"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -27,3 +29,134 @@ func TestMessage(t *testing.T) {
 		assert.Equal(t, msg, msg2)
 	}
 }
+
+func TestMessage_Reply(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer1.Peers = append(peer1.Peers, *(peer2.Identities[0].Peer(peer2.Destination)))
+	msg := &Message{
+		Verb:    "ping",
+		Payload: "pong",
+	}
+	d, err := msg.EncodeReply(peer2)
+	if err != nil {
+		t.Fatalf("EncodeReply: %s", err)
+	}
+	if msg2, err := DecodeReply(peer1, d); err != nil {
+		t.Fatalf("DecodeReply: %s", err)
+	} else {
+		assert.Equal(t, msg, msg2)
+	}
+}
+
+func TestDecodeStoredMessage(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	msg := &Message{
+		Destination: "remaphore",
+		Verb:        "ping",
+	}
+	d, err := msg.EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	storedAt := time.Unix(0, msg.SendTimeNano)
+	if _, err := DecodeStoredMessage(peer2, d, storedAt); err != nil {
+		t.Errorf("Decode: %s", err)
+	}
+	if _, err := DecodeStoredMessage(peer2, d, storedAt.Add(peer2.AllowedClockSkew*2)); err != ErrClockSkew {
+		t.Errorf("Stored late: %v", err)
+	}
+	peer2.MaxReplayAge = time.Nanosecond
+	if _, err := DecodeStoredMessage(peer2, d, storedAt); err != ErrClockSkew {
+		t.Errorf("Too old: %v", err)
+	}
+}
+
+func TestMessage_Flags(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	msg := &Message{
+		Destination:  "remaphore",
+		Verb:         "ping",
+		RequestReply: true,
+		Follow:       true,
+		Ack:          true,
+	}
+	d, err := msg.EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	msg2, err := DecodeMessage(peer2, d)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !msg2.RequestReply || !msg2.Follow || !msg2.Ack {
+		t.Error("Flags not decoded")
+	}
+}
+
+func TestNewCancel(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer1.Identities[0].Permissions = []string{"deploy"}
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	request := &Message{
+		Destination:  "remaphore",
+		Verb:         "deploy",
+		RequestReply: true,
+	}
+	if _, err := request.EncodeMessage(peer1); err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	d, err := NewCancel(request).EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage cancel: %s", err)
+	}
+	cancel, err := DecodeMessage(peer2, d)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if !cancel.IsCancel() || cancel.PermissionVerb() != "deploy" || cancel.Payload != hex.EncodeToString(request.Hash) {
+		t.Errorf("Bad cancel: %s %s", cancel.Verb, cancel.Payload)
+	}
+	peer2.Peers[0].Permissions = []string{"ping"}
+	if _, err := DecodeMessage(peer2, d); err != ErrPeerPermission {
+		t.Errorf("Cancel without permission for verb: %v", err)
+	}
+}
+
+func TestMessage_Validity(t *testing.T) {
+	sender := NewConfig()
+	receiver := NewConfig()
+	receiver.Peers = append(receiver.Peers, *sender.Identities[0].Peer(sender.Destination))
+	receiver.MaxValidity = time.Hour
+	at := time.Now().Add(time.Minute)
+	msg := &Message{Destination: receiver.Destination, Verb: "ping", Ack: true, Validity: 30 * time.Minute}
+	d, err := msg.EncodeMessageAt(sender, at)
+	if err != nil {
+		t.Fatalf("EncodeMessageAt: %s", err)
+	}
+	if _, err := DecodeMessage(receiver, d); err != ErrClockSkew {
+		t.Errorf("Decode before send time: %v", err)
+	}
+	decoded, err := DecodeMessageAt(receiver, d, at.Add(20*time.Minute))
+	if err != nil {
+		t.Fatalf("Decode within validity: %s", err)
+	}
+	if decoded.Validity != 30*time.Minute || !decoded.Ack {
+		t.Errorf("Flags not decoded: %v %v", decoded.Validity, decoded.Ack)
+	}
+	if !decoded.ValidUntil(receiver).Equal(time.Unix(0, msg.SendTimeNano).Add(30*time.Minute + receiver.AllowedClockSkew)) {
+		t.Errorf("ValidUntil: %s", decoded.ValidUntil(receiver))
+	}
+	if _, err := DecodeMessageAt(receiver, d, at.Add(31*time.Minute)); err != ErrClockSkew {
+		t.Errorf("Decode after validity: %v", err)
+	}
+	receiver.MaxValidity = 0
+	if _, err := DecodeMessageAt(receiver, d, at); err != ErrValidity {
+		t.Errorf("Decode validity beyond max_validity: %v", err)
+	}
+}
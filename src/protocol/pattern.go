@@ -0,0 +1,435 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxExpansions limits the number of patterns that alternations expand to.
+const maxExpansions = 1024
+
+// Pattern is a compiled destination pattern. The syntax is:
+//
+//	pattern   = item { "," item }
+//	item      = [ "!" ] segment { "." segment }
+//	segment   = "**" | { literal | "*" | range | alternation }
+//
+// "*" matches any characters within a segment, "**" matches one or more whole segments
+// at any position. "[001-040]" matches a decimal number in the range; if both bounds
+// have the same number of digits, the number must have that many digits. "{us,eu}"
+// matches one of the alternatives, which may contain dots and nest. A destination
+// matches if it matches any item that is not negated and none of the negated items.
+// A pattern of only negated items matches all destinations not excluded.
+type Pattern struct {
+	source  string
+	include []segments
+	exclude []segments
+}
+
+type segments []segment
+
+type segment struct {
+	any    bool // "**"
+	tokens []token
+}
+
+const (
+	tokLiteral = iota
+	tokStar
+	tokRange
+)
+
+type token struct {
+	kind    int
+	literal string
+	lo, hi  uint64
+	width   int // Required number of digits of a range, 0 for any.
+}
+
+func patternError(source, reason string) error {
+	return fmt.Errorf("bad pattern \"%s\": %s", source, reason)
+}
+
+// CompilePattern parses a destination pattern.
+func CompilePattern(source string) (*Pattern, error) {
+	ret := &Pattern{source: source}
+	items, err := splitTop(source)
+	if err != nil {
+		return nil, patternError(source, err.Error())
+	}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		negate := strings.HasPrefix(item, "!")
+		if negate {
+			item = item[1:]
+		}
+		if len(item) == 0 {
+			return nil, patternError(source, "empty pattern")
+		}
+		expanded, err := expandAlternations(item, nil)
+		if err != nil {
+			return nil, patternError(source, err.Error())
+		}
+		for _, e := range expanded {
+			segs, err := parseSegments(e)
+			if err != nil {
+				return nil, patternError(source, err.Error())
+			}
+			if negate {
+				ret.exclude = append(ret.exclude, segs)
+			} else {
+				ret.include = append(ret.include, segs)
+			}
+		}
+	}
+	if len(ret.include) == 0 {
+		ret.include = []segments{{{any: true}}}
+	}
+	return ret, nil
+}
+
+// MustCompilePattern is CompilePattern that panics on errors.
+func MustCompilePattern(source string) *Pattern {
+	ret, err := CompilePattern(source)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+func (pattern *Pattern) String() string {
+	return pattern.source
+}
+
+// Match returns true if the destination name matches the pattern. Names that
+// contain pattern characters never match.
+func (pattern *Pattern) Match(name string) bool {
+	if !validName(name) {
+		return false
+	}
+	f := strings.Split(name, destSeparator)
+	for _, segs := range pattern.exclude {
+		if segs.match(f) {
+			return false
+		}
+	}
+	for _, segs := range pattern.include {
+		if segs.match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func validName(name string) bool {
+	return len(name) > 0 && !strings.ContainsAny(name, "*{}[]!,?% \t")
+}
+
+// SplitPatternList splits a comma-separated list of patterns. Commas within
+// alternations do not separate patterns.
+func SplitPatternList(s string) ([]string, error) {
+	ret, err := splitTop(s)
+	if err != nil {
+		return nil, patternError(s, err.Error())
+	}
+	return ret, nil
+}
+
+// splitTop splits s at commas that are not within alternations.
+func splitTop(s string) ([]string, error) {
+	var ret []string
+	var depth, start int
+	for i, c := range s {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("unbalanced '}'")
+			}
+		case ',':
+			if depth == 0 {
+				ret = append(ret, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced '{'")
+	}
+	return append(ret, s[start:]), nil
+}
+
+// expandAlternations appends the patterns that the alternations in s expand to.
+func expandAlternations(s string, ret []string) ([]string, error) {
+	open := strings.Index(s, "{")
+	if open < 0 {
+		if len(ret) >= maxExpansions {
+			return nil, fmt.Errorf("more than %d alternatives", maxExpansions)
+		}
+		return append(ret, s), nil
+	}
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth > 0 {
+				continue
+			}
+			alternatives, err := splitTop(s[open+1 : i])
+			if err != nil {
+				return nil, err
+			}
+			for _, alt := range alternatives {
+				if ret, err = expandAlternations(s[:open]+alt+s[i+1:], ret); err != nil {
+					return nil, err
+				}
+			}
+			return ret, nil
+		}
+	}
+	return nil, fmt.Errorf("unbalanced '{'")
+}
+
+func parseSegments(s string) (segments, error) {
+	f := strings.Split(s, destSeparator)
+	ret := make(segments, len(f))
+	for i, seg := range f {
+		if seg == "**" {
+			ret[i].any = true
+			continue
+		}
+		tokens, err := parseTokens(seg)
+		if err != nil {
+			return nil, err
+		}
+		ret[i].tokens = tokens
+	}
+	return ret, nil
+}
+
+func parseTokens(s string) ([]token, error) {
+	var ret []token
+	if len(s) == 0 {
+		return nil, fmt.Errorf("empty segment")
+	}
+	if strings.Contains(s, "**") {
+		return nil, fmt.Errorf("'**' must be a whole segment")
+	}
+	for len(s) > 0 {
+		switch s[0] {
+		case '*':
+			ret = append(ret, token{kind: tokStar})
+			s = s[1:]
+		case '[':
+			end := strings.Index(s, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unbalanced '['")
+			}
+			r, err := parseRange(s[1:end])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, r)
+			s = s[end+1:]
+		default:
+			n := strings.IndexAny(s, "*[")
+			if n < 0 {
+				n = len(s)
+			}
+			literal := s[:n]
+			if strings.ContainsAny(literal, "]{}!?%, \t") {
+				return nil, fmt.Errorf("forbidden character in \"%s\"", literal)
+			}
+			ret = append(ret, token{kind: tokLiteral, literal: literal})
+			s = s[n:]
+		}
+	}
+	return ret, nil
+}
+
+func parseRange(s string) (token, error) {
+	f := strings.Split(s, "-")
+	if len(f) != 2 || !isDigits(f[0]) || !isDigits(f[1]) {
+		return token{}, fmt.Errorf("bad range \"[%s]\"", s)
+	}
+	lo, err1 := strconv.ParseUint(f[0], 10, 64)
+	hi, err2 := strconv.ParseUint(f[1], 10, 64)
+	if err1 != nil || err2 != nil || lo > hi {
+		return token{}, fmt.Errorf("bad range \"[%s]\"", s)
+	}
+	ret := token{kind: tokRange, lo: lo, hi: hi}
+	if len(f[0]) == len(f[1]) {
+		ret.width = len(f[0])
+	}
+	return ret, nil
+}
+
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns true if the segments match the names. It fills a table of which
+// suffixes of segs match which suffixes of names, bottom up, so that patterns with
+// many "**" cannot make it backtrack exponentially.
+func (segs segments) match(names []string) bool {
+	// next[j] is true if segs[i+1:] matches names[j:], row[j] if segs[i:] does.
+	next := make([]bool, len(names)+1)
+	row := make([]bool, len(names)+1)
+	next[len(names)] = true
+	for i := len(segs) - 1; i >= 0; i-- {
+		row[len(names)] = false
+		for j := len(names) - 1; j >= 0; j-- {
+			if segs[i].any {
+				// "**" takes names[j] and possibly more.
+				row[j] = next[j+1] || row[j+1]
+			} else {
+				row[j] = next[j+1] && matchTokens(names[j], segs[i].tokens)
+			}
+		}
+		next, row = row, next
+	}
+	return next[0]
+}
+
+// maxRangeDigits is the most digits a number matched by a range can have.
+const maxRangeDigits = 20
+
+// matchTokens returns true if the tokens match s. Like segments.match it fills a
+// table, which bounds the time to O(len(s) * len(tokens)).
+func matchTokens(s string, tokens []token) bool {
+	// next[p] is true if tokens[k+1:] matches s[p:], row[p] if tokens[k:] does.
+	next := make([]bool, len(s)+1)
+	row := make([]bool, len(s)+1)
+	next[len(s)] = true
+	for k := len(tokens) - 1; k >= 0; k-- {
+		t := tokens[k]
+		for p := len(s); p >= 0; p-- {
+			switch t.kind {
+			case tokLiteral:
+				row[p] = strings.HasPrefix(s[p:], t.literal) && next[p+len(t.literal)]
+			case tokStar:
+				row[p] = next[p] || p < len(s) && row[p+1]
+			default:
+				row[p] = matchRange(s[p:], t, next[p:])
+			}
+		}
+		next, row = row, next
+	}
+	return next[0]
+}
+
+// matchRange returns true if a prefix of s of length n is a number in the range of t
+// and rest[n] is true.
+func matchRange(s string, t token, rest []bool) bool {
+	digits := 0
+	for digits < len(s) && digits < maxRangeDigits && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+	for n := 1; n <= digits; n++ {
+		if t.width > 0 && n != t.width || t.width == 0 && n > 1 && s[0] == '0' || !rest[n] {
+			continue
+		}
+		v, err := strconv.ParseUint(s[:n], 10, 64)
+		if err != nil {
+			break
+		}
+		if v >= t.lo && v <= t.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns true if every destination that other matches is matched by the
+// pattern. The check is conservative: it may return false for some patterns that
+// are contained, e.g. "web-*" in "web*". Exclusions of other are not considered.
+func (pattern *Pattern) Contains(other *Pattern) bool {
+	for _, segs := range other.include {
+		if name, ok := segs.literal(); ok {
+			if !pattern.Match(name) {
+				return false
+			}
+			continue
+		}
+		if len(pattern.exclude) > 0 {
+			return false
+		}
+		contained := false
+		for _, outer := range pattern.include {
+			if outer.contains(segs) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return false
+		}
+	}
+	return true
+}
+
+// literal returns the destination the segments match if they contain no wildcards.
+func (segs segments) literal() (string, bool) {
+	f := make([]string, len(segs))
+	for i, seg := range segs {
+		if seg.any || len(seg.tokens) != 1 || seg.tokens[0].kind != tokLiteral {
+			return "", false
+		}
+		f[i] = seg.tokens[0].literal
+	}
+	return strings.Join(f, destSeparator), true
+}
+
+// contains returns true if segs matches all destinations that inner matches.
+func (segs segments) contains(inner segments) bool {
+	if len(inner) == 0 {
+		return len(segs) == 0
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if segs[0].any {
+		// "**" takes the first inner segment and possibly more.
+		return segs[1:].contains(inner[1:]) || segs.contains(inner[1:])
+	}
+	if inner[0].any || !tokensContain(segs[0].tokens, inner[0].tokens) {
+		return false
+	}
+	return segs[1:].contains(inner[1:])
+}
+
+// tokensContain returns true if the segment outer matches all that the segment inner matches.
+func tokensContain(outer, inner []token) bool {
+	if len(inner) == 1 && inner[0].kind == tokLiteral {
+		return matchTokens(inner[0].literal, outer)
+	}
+	if len(outer) == 1 && outer[0].kind == tokStar {
+		return true
+	}
+	if len(outer) != len(inner) {
+		return false
+	}
+	for i, o := range outer {
+		in := inner[i]
+		if o.kind == tokRange && in.kind == tokRange {
+			if o.width != in.width || in.lo < o.lo || in.hi > o.hi {
+				return false
+			}
+		} else if o != in {
+			return false
+		}
+	}
+	return true
+}
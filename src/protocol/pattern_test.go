@@ -0,0 +1,227 @@
+package protocol
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestCompilePattern(t *testing.T) {
+	for pattern, names := range map[string]map[string]bool{
+		"com.*.us.*": {
+			"com.crypto.us.left": true,
+			"com.crypto.eu.left": false,
+			"com.crypto.us":      false,
+		},
+		"com.*-*.us": {
+			"com.a-b.us":   true,
+			"com.a-b-c.us": true,
+			"com.ab.us":    false,
+		},
+		"com.**.left": {
+			"com.crypto.us.left": true,
+			"com.left":           false,
+			"com.crypto.right":   false,
+		},
+		"**.left": {
+			"left":            false,
+			"com.left":        true,
+			"com.us.eu.left":  true,
+			"com.us.eu.right": false,
+		},
+		"com.crypto.{us,eu}.left": {
+			"com.crypto.us.left": true,
+			"com.crypto.eu.left": true,
+			"com.crypto.ap.left": false,
+		},
+		"{com.crypto,net.{opaque,other}}.*": {
+			"com.crypto.x": true,
+			"net.opaque.x": true,
+			"net.other.x":  true,
+			"net.crypto.x": false,
+		},
+		"host[001-040]": {
+			"host001": true,
+			"host040": true,
+			"host041": false,
+			"host1":   false,
+			"host000": false,
+		},
+		"host[1-100].*": {
+			"host1.a":   true,
+			"host100.a": true,
+			"host01.a":  false,
+			"host101.a": false,
+		},
+		"*[1-3]x": {
+			"a2x":  true,
+			"a23x": true,
+			"a4x":  false,
+		},
+		"com.**,!com.crypto.eu.*": {
+			"com.crypto.us.left": true,
+			"com.crypto.eu.left": false,
+			"net.crypto.us.left": false,
+		},
+		"!com.crypto.eu.*": {
+			"com.crypto.us.left": true,
+			"com.crypto.eu.left": false,
+			"anything":           true,
+		},
+		"a.b, c.d": {
+			"a.b": true,
+			"c.d": true,
+			"a.d": false,
+		},
+	} {
+		p, err := CompilePattern(pattern)
+		if err != nil {
+			t.Errorf("CompilePattern(%q): %s", pattern, err)
+			continue
+		}
+		for name, match := range names {
+			if p.Match(name) != match {
+				t.Errorf("%q matches %q: %v", pattern, name, !match)
+			}
+		}
+	}
+	for _, pattern := range []string{"", "a..b", "a.", "a**", "a.**b", "{a,b", "a}", "a.[1-x]", "a[3-1]", "a[1-2", "a]", "!", "a,,b", "a.!b", "a b", "a?b", "a%b"} {
+		if _, err := CompilePattern(pattern); err == nil {
+			t.Errorf("CompilePattern(%q) accepted", pattern)
+		}
+	}
+	if MatchWildcards("com.*", "**") {
+		t.Error("Pattern matches as name")
+	}
+	if _, err := CompilePattern(strings.Repeat("{a,b}", 11)); err == nil {
+		t.Error("Expansion not limited")
+	}
+}
+
+// destName is a random destination name.
+type destName string
+
+func (destName) Generate(r *rand.Rand, size int) reflect.Value {
+	f := make([]string, 1+r.Intn(5))
+	for i := range f {
+		f[i] = randomSegment(r)
+	}
+	return reflect.ValueOf(destName(strings.Join(f, ".")))
+}
+
+func randomSegment(r *rand.Rand) string {
+	const chars = "abcxyz0123-_"
+	b := make([]byte, 1+r.Intn(6))
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// wildcard replaces random segments of name with wildcards that still match them.
+func wildcard(r *rand.Rand, name string) string {
+	f := strings.Split(name, ".")
+	for i := range f {
+		switch r.Intn(4) {
+		case 0:
+			f[i] = "*"
+		case 1:
+			f[i] = f[i][:r.Intn(len(f[i])+1)] + "*"
+		case 2:
+			f[i] = "{" + randomSegment(r) + "," + f[i] + "}"
+		}
+	}
+	if n := len(f); n > 1 && r.Intn(2) == 0 {
+		i := r.Intn(n)
+		j := i + 1 + r.Intn(n-i)
+		f = append(append(append([]string(nil), f[:i]...), "**"), f[j:]...)
+	}
+	return strings.Join(f, ".")
+}
+
+func TestPattern_Properties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	config := &quick.Config{Rand: r, MaxCount: 2000}
+	literal := func(name destName) bool {
+		return MatchWildcards(string(name), string(name)) && MatchWildcards(string(name), "**")
+	}
+	wildcards := func(name destName) bool {
+		return MatchWildcards(string(name), wildcard(r, string(name)))
+	}
+	negation := func(name, other destName) bool {
+		p := wildcard(r, string(other))
+		return MatchWildcards(string(name), "!"+p) != MatchWildcards(string(name), p)
+	}
+	list := func(name, a, b destName) bool {
+		pa, pb := wildcard(r, string(a)), wildcard(r, string(b))
+		either := MatchWildcards(string(name), pa) || MatchWildcards(string(name), pb)
+		return MatchWildcards(string(name), pa+","+pb) == either && MatchWildcards(string(name), "{"+pa+","+pb+"}") == either
+	}
+	for name, f := range map[string]interface{}{"literal": literal, "wildcards": wildcards, "negation": negation, "list": list} {
+		if err := quick.Check(f, config); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestCompilePattern_NoPanic(t *testing.T) {
+	const chars = "ab1.*{},[]-!"
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 20000; i++ {
+		b := make([]byte, r.Intn(12))
+		for j := range b {
+			b[j] = chars[r.Intn(len(chars))]
+		}
+		if p, err := CompilePattern(string(b)); err == nil {
+			p.Match("ab.a1.b")
+		}
+	}
+}
+
+func TestMessage_Pattern(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	peer2.Destination = "com.crypto.us.left"
+	msg := &Message{
+		Destination: "com.crypto.{us,eu}.*,!*.*.*.right",
+		Verb:        "ping",
+	}
+	d, err := msg.EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	msg2, err := DecodeMessage(peer2, d)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if msg2.Destination != msg.Destination || !msg2.Match(peer2, MatchDestination()) {
+		t.Errorf("Destination not matched: %s", msg2.Destination)
+	}
+	if _, err := (&Message{Destination: "com.{us", Verb: "ping"}).EncodeMessage(peer1); err == nil {
+		t.Error("Bad pattern sent")
+	}
+}
+
+func TestPattern_MatchTime(t *testing.T) {
+	name := strings.Repeat("a", 40)
+	long := strings.Repeat("a.", 40) + "b"
+	for _, c := range []struct{ pattern, name string }{
+		{strings.Repeat("*a", 10) + "*b", name},
+		{strings.Repeat("*a", 30) + "*b", name + name},
+		{strings.Repeat("**.", 20) + "c", long},
+		{strings.Repeat("**.a.", 10) + "**.c", long},
+		{strings.Repeat("*[0-9]", 10) + "x", strings.Repeat("1", 60)},
+	} {
+		start := time.Now()
+		if MatchWildcards(c.name, c.pattern) {
+			t.Errorf("%s matches %s", c.pattern, c.name)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("%s took %s", c.pattern, d)
+		}
+	}
+}
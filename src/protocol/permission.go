@@ -0,0 +1,262 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Permissions are lists of verb patterns. Verbs are hierarchical with dots like
+// destinations: "deploy.*" permits "deploy.web" and "deploy.db", "deploy.**" also
+// "deploy.web.canary". "*" permits all verbs. Entries starting with "!" deny the
+// verbs they match and override all other entries. Entries "verb@scope" only permit
+// messages the destination pattern of which is contained in the scope pattern. Entries
+// "verb~window" only apply within the named time window.
+
+const (
+	denyPrefix = "!" // Marks a permission entry that denies verbs.
+	scopeSep   = "@" // Separates the verb pattern from the destination scope.
+	windowSep  = "~" // Separates the verb pattern or scope from the time window.
+)
+
+// permission is a compiled permission entry.
+type permission struct {
+	verb   *Pattern
+	scope  *Pattern // Nil if the entry applies to all destinations.
+	window string   // Name of the time window the entry is restricted to, "" for none.
+	deny   bool
+}
+
+// permissionContext is what permission entries are evaluated against.
+type permissionContext struct {
+	destination string      // Destination pattern of the message, "" if unknown.
+	times       []time.Time // Times that must lie within the windows of windowed entries.
+	windows     Windows
+}
+
+// permissionCache caches compiled permission entries.
+var permissionCache sync.Map
+
+// compilePermission returns the compiled permission entry, or nil if the entry is invalid.
+func compilePermission(entry string) *permission {
+	if p, ok := permissionCache.Load(entry); ok {
+		return p.(*permission)
+	}
+	p, err := parsePermission(entry)
+	if err != nil {
+		p = nil
+	}
+	permissionCache.Store(entry, p)
+	return p
+}
+
+func parsePermission(entry string) (*permission, error) {
+	ret := new(permission)
+	verb := entry
+	if strings.HasPrefix(verb, denyPrefix) {
+		ret.deny, verb = true, verb[len(denyPrefix):]
+	}
+	if p := strings.Index(verb, windowSep); p >= 0 {
+		if err := ValidRoleName(verb[p+1:]); err != nil {
+			return nil, err
+		}
+		ret.window, verb = verb[p+1:], verb[:p]
+	}
+	if p := strings.Index(verb, scopeSep); p >= 0 {
+		if ret.deny {
+			return nil, fmt.Errorf("deny entries cannot be scoped")
+		}
+		scope, err := CompilePattern(verb[p+1:])
+		if err != nil {
+			return nil, err
+		}
+		ret.scope, verb = scope, verb[:p]
+	}
+	if items, _ := splitTop(verb); len(items) != 1 || strings.HasPrefix(verb, denyPrefix) {
+		return nil, fmt.Errorf("not a single verb pattern")
+	}
+	if verb == "*" {
+		verb = "**"
+	}
+	p, err := CompilePattern(verb)
+	if err != nil {
+		return nil, err
+	}
+	ret.verb = p
+	return ret, nil
+}
+
+// ValidPermission returns an error if entry is not a valid permission entry.
+func ValidPermission(entry string) error {
+	if compilePermission(entry) == nil {
+		return fmt.Errorf("bad permission: \"%s\"", entry)
+	}
+	return nil
+}
+
+// inScope returns true if the entry applies to messages sent to destination. Scoped
+// entries do not apply if the destination is unknown.
+func (p *permission) inScope(destination string) bool {
+	if p.scope == nil {
+		return true
+	}
+	if destination == "" {
+		return false
+	}
+	d, err := CompilePattern(destination)
+	return err == nil && p.scope.Contains(d)
+}
+
+// inWindow returns true if the entry applies at the times of ctx. Windowed entries that
+// allow verbs apply if all times are within the window, the ones that deny verbs if any
+// is. If the times are unknown only deny entries apply.
+func (p *permission) inWindow(ctx *permissionContext) bool {
+	if p.window == "" {
+		return true
+	}
+	if len(ctx.times) == 0 {
+		return p.deny
+	}
+	if !p.deny {
+		return ctx.windows.Contains(p.window, ctx.times...)
+	}
+	for _, t := range ctx.times {
+		if ctx.windows.Contains(p.window, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionWindow returns the name of the time window of a permission entry, or "".
+func PermissionWindow(entry string) string {
+	if p := compilePermission(entry); p != nil {
+		return p.window
+	}
+	return ""
+}
+
+// PermissionStep is the result of one permission entry for a verb.
+type PermissionStep struct {
+	Entry       string
+	Matches     bool
+	Deny        bool
+	OutOfScope  bool // The verb matches, but the destination is not within the scope.
+	OutOfWindow bool // The verb matches, but the time is not within the window.
+}
+
+func (step PermissionStep) String() string {
+	switch {
+	case step.OutOfScope:
+		return fmt.Sprintf("%s: out of scope", step.Entry)
+	case step.OutOfWindow:
+		return fmt.Sprintf("%s: out of window", step.Entry)
+	case !step.Matches:
+		return fmt.Sprintf("%s: no match", step.Entry)
+	case step.Deny:
+		return fmt.Sprintf("%s: deny", step.Entry)
+	}
+	return fmt.Sprintf("%s: allow", step.Entry)
+}
+
+// PermissionTrace records how a permission decision for a verb was reached.
+type PermissionTrace struct {
+	Verb        string
+	Destination string
+	Allowed     bool
+	Steps       []PermissionStep
+}
+
+func (trace *PermissionTrace) String() string {
+	lines := make([]string, 0, len(trace.Steps)+1)
+	decision := "denied"
+	if trace.Allowed {
+		decision = "allowed"
+	}
+	if len(trace.Destination) > 0 {
+		lines = append(lines, fmt.Sprintf("%s@%s: %s", trace.Verb, trace.Destination, decision))
+	} else {
+		lines = append(lines, fmt.Sprintf("%s: %s", trace.Verb, decision))
+	}
+	for _, step := range trace.Steps {
+		lines = append(lines, "  "+step.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TracePermission evaluates permissions for verb sent to destination, if given, and
+// returns the result of every entry. Windowed entries that allow verbs do not apply.
+func TracePermission(permissions []string, verb string, destination ...string) *PermissionTrace {
+	ctx := new(permissionContext)
+	if len(destination) > 0 {
+		ctx.destination = destination[0]
+	}
+	return ctx.trace(permissions, verb)
+}
+
+func (ctx *permissionContext) trace(permissions []string, verb string) *PermissionTrace {
+	ret := &PermissionTrace{Verb: verb, Destination: ctx.destination}
+	ret.Allowed = evalPermission(permissions, verb, ctx, ret)
+	return ret
+}
+
+// OutOfWindow returns true if the verb was denied only because windowed entries that
+// would allow it do not apply at this time.
+func (trace *PermissionTrace) OutOfWindow() bool {
+	if trace.Allowed {
+		return false
+	}
+	outOfWindow := false
+	for _, step := range trace.Steps {
+		if step.Matches && step.Deny {
+			return false
+		}
+		outOfWindow = outOfWindow || step.OutOfWindow && !step.Deny
+	}
+	return outOfWindow
+}
+
+// evalPermission returns true if permissions allow verb in ctx. Every entry is
+// recorded in trace, if not nil.
+func evalPermission(permissions []string, verb string, ctx *permissionContext, trace *PermissionTrace) bool {
+	var allowed, denied bool
+	for _, entry := range permissions {
+		deny := strings.HasPrefix(entry, denyPrefix)
+		if trace == nil && (denied || allowed && !deny) {
+			continue
+		}
+		p := compilePermission(entry)
+		step := PermissionStep{Entry: entry, Deny: deny}
+		if p != nil && p.verb.Match(verb) {
+			step.OutOfScope = !p.inScope(ctx.destination)
+			step.OutOfWindow = !step.OutOfScope && !p.inWindow(ctx)
+			step.Matches = !step.OutOfScope && !step.OutOfWindow
+		}
+		if step.Matches && deny {
+			denied = true
+		} else if step.Matches {
+			allowed = true
+		}
+		trace.add(step)
+	}
+	return allowed && !denied
+}
+
+func (trace *PermissionTrace) add(step PermissionStep) {
+	if trace != nil {
+		trace.Steps = append(trace.Steps, step)
+	}
+}
+
+func testPermission(permissions []string, verb ...string) bool {
+	if verb == nil || len(verb) == 0 {
+		return true
+	}
+	return evalPermission(permissions, verb[0], new(permissionContext), nil)
+}
+
+// testPermissionAt is testPermission for messages sent to destination.
+func testPermissionAt(permissions []string, verb, destination string) bool {
+	return evalPermission(permissions, verb, &permissionContext{destination: destination}, nil)
+}
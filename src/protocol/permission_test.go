@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTestPermission(t *testing.T) {
+	permissions := []string{"ping", "deploy.*", "build.**", "!deploy.db", "restart.{web,api}"}
+	for verb, allowed := range map[string]bool{
+		"ping":              true,
+		"pong":              false,
+		"deploy":            false,
+		"deploy.web":        true,
+		"deploy.db":         false,
+		"deploy.web.canary": false,
+		"build.a.b":         true,
+		"restart.api":       true,
+		"restart.db":        false,
+	} {
+		if testPermission(permissions, verb) != allowed {
+			t.Errorf("%s allowed: %v", verb, !allowed)
+		}
+	}
+	all := []string{"*", "!shutdown", "!maintenance.*"}
+	assert.True(t, testPermission(all, "deploy.web.canary"))
+	assert.False(t, testPermission(all, "shutdown"))
+	assert.False(t, testPermission(all, "maintenance.start"))
+	assert.True(t, testPermission(all))
+	assert.False(t, testPermission([]string{"!ping", "ping"}, "ping"), "deny must override allow")
+	assert.False(t, testPermission([]string{"bad{"}, "bad{"))
+}
+
+func TestTracePermission(t *testing.T) {
+	trace := TracePermission([]string{"ping", "deploy.*", "!deploy.db"}, "deploy.db")
+	assert.False(t, trace.Allowed)
+	assert.Equal(t, []PermissionStep{
+		{Entry: "ping"},
+		{Entry: "deploy.*", Matches: true},
+		{Entry: "!deploy.db", Matches: true, Deny: true},
+	}, trace.Steps)
+	assert.Equal(t, "deploy.db: denied\n  ping: no match\n  deploy.*: allow\n  !deploy.db: deny", trace.String())
+	assert.True(t, TracePermission([]string{"*"}, "x.y").Allowed)
+}
+
+func TestValidPermission(t *testing.T) {
+	for _, entry := range []string{"ping", "*", "!*", "deploy.*", "!deploy.db", "a.{b,c}", "host[1-3]", "reboot~maintenance", "!deploy~freeze", "restart@com.*~night"} {
+		assert.NoError(t, ValidPermission(entry), entry)
+	}
+	for _, entry := range []string{"!", "a..b", "a{", "!!a", "a,b", "a~", "a~b.c", "a~b@c"} {
+		assert.Error(t, ValidPermission(entry), entry)
+	}
+}
+
+func TestTestPermissionAt(t *testing.T) {
+	permissions := []string{"ping", "restart@com.crypto.us.*", "deploy.*@{web,api}[1-9]"}
+	for _, c := range []struct {
+		verb, destination string
+		allowed           bool
+	}{
+		{"ping", "**", true},
+		{"restart", "com.crypto.us.left", true},
+		{"restart", "com.crypto.us.*", true},
+		{"restart", "com.crypto.us.{left,right}", true},
+		{"restart", "com.crypto.eu.left", false},
+		{"restart", "com.crypto.*.left", false},
+		{"restart", "**", false},
+		{"restart", "", false},
+		{"deploy.web", "web3", true},
+		{"deploy.web", "web[1-3]", true},
+		{"deploy.web", "web*", false},
+	} {
+		if testPermissionAt(permissions, c.verb, c.destination) != c.allowed {
+			t.Errorf("%s@%s allowed: %v", c.verb, c.destination, !c.allowed)
+		}
+	}
+	assert.False(t, testPermission(permissions, "restart"), "scoped entry without destination")
+	trace := TracePermission(permissions, "restart", "**")
+	assert.Equal(t, "restart@**: denied\n  ping: no match\n  restart@com.crypto.us.*: out of scope\n  deploy.*@{web,api}[1-9]: no match", trace.String())
+}
+
+func TestPattern_Contains(t *testing.T) {
+	for _, c := range []struct {
+		outer, inner string
+		contains     bool
+	}{
+		{"**", "a.*.c", true},
+		{"a.**", "a.b.**", true},
+		{"a.**", "**", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b*", true},
+		{"a.*", "a.b.c", false},
+		{"a.b*", "a.b*", true},
+		{"a.b*", "a.*", false},
+		{"a.{b,c}", "a.b,a.c", true},
+		{"a.{b,c}", "a.*", false},
+		{"host[1-9]", "host[1-9]", true},
+		{"host[1-9]", "host5", true},
+		{"*,!a", "b", true},
+		{"*,!a", "b*", false},
+	} {
+		if MustCompilePattern(c.outer).Contains(MustCompilePattern(c.inner)) != c.contains {
+			t.Errorf("%s contains %s: %v", c.outer, c.inner, !c.contains)
+		}
+	}
+}
+
+func TestMessage_ScopedPermission(t *testing.T) {
+	sender := NewConfig()
+	sender.Identities[0].Permissions = []string{"restart@com.crypto.us.*"}
+	receiver := NewConfig()
+	peer := sender.Identities[0].Peer(sender.Destination)
+	peer.Permissions = []string{"restart@com.crypto.us.*"}
+	receiver.Peers = append(receiver.Peers, *peer)
+	d, err := (&Message{Destination: "com.crypto.us.left", Verb: "restart"}).EncodeMessage(sender)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	if _, err := DecodeMessage(receiver, d); err != nil {
+		t.Errorf("Decode in scope: %s", err)
+	}
+	if _, err := (&Message{Destination: "**", Verb: "restart"}).EncodeMessage(sender); err != ErrNoPrivateKey {
+		t.Errorf("Encode out of scope: %v", err)
+	}
+	sender.Identities[0].Permissions = []string{"restart"}
+	d, err = (&Message{Destination: "**", Verb: "restart"}).EncodeMessage(sender)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	if _, err := DecodeMessage(receiver, d); err != ErrPeerPermission {
+		t.Errorf("Decode out of scope: %v", err)
+	}
+}
+
+func TestConfig_PotentialReceiversFor(t *testing.T) {
+	c := NewConfig()
+	c.Identities[0].Permissions = []string{"ping", "restart@com.crypto.us.*"}
+	c.Peers = Peers{{Destination: "com.crypto.us.left"}, {Destination: "com.crypto.eu.left"}}
+	assert.Len(t, c.PotentialReceiversFor(c.DefaultKey, "ping", "**"), 2)
+	receivers := c.PotentialReceiversFor(c.DefaultKey, "restart", "com.crypto.*.left")
+	if len(receivers) != 1 || receivers[0].Destination != "com.crypto.us.left" {
+		t.Errorf("Receivers: %v", receivers)
+	}
+}
+
+func TestMessage_WindowedPermission(t *testing.T) {
+	sender := NewConfig()
+	receiver := NewConfig()
+	peer := sender.Identities[0].Peer(sender.Destination)
+	peer.Permissions = []string{"ping", "reboot~maintenance", "!deploy~freeze", "deploy"}
+	receiver.Peers = append(receiver.Peers, *peer)
+	sender.Identities[0].Permissions = []string{"*"}
+	send := func(verb string) error {
+		d, err := (&Message{Destination: receiver.Destination, Verb: verb}).EncodeMessage(sender)
+		if err != nil {
+			t.Fatalf("EncodeMessage: %s", err)
+		}
+		_, err = DecodeMessage(receiver, d)
+		return err
+	}
+	always, _ := ParseWindow("* 00:00-24:00")
+	never, _ := ParseWindow("2000-01-01T00:00:00Z/2000-01-02T00:00:00Z")
+	receiver.Windows = Windows{"maintenance": {never}, "freeze": {never}}
+	assert.Equal(t, ErrPermissionWindow, send("reboot"))
+	assert.NoError(t, send("deploy"))
+	assert.Equal(t, ErrPeerPermission, send("shutdown"))
+	receiver.Windows = Windows{"maintenance": {always}, "freeze": {always}}
+	assert.NoError(t, send("reboot"))
+	assert.Equal(t, ErrPeerPermission, send("deploy"))
+	assert.Equal(t, []string{"ping", "reboot~maintenance", "!deploy~freeze", "deploy"}, receiver.EffectivePermissions(peer.Permissions, time.Now()))
+	receiver.Windows = Windows{"maintenance": {never}, "freeze": {never}}
+	assert.Equal(t, []string{"ping", "deploy"}, receiver.EffectivePermissions(peer.Permissions, time.Now()))
+	trace := receiver.TracePermission(peer.Permissions, "reboot", "", time.Now())
+	assert.True(t, trace.OutOfWindow())
+	assert.Contains(t, trace.String(), "reboot~maintenance: out of window")
+	assert.False(t, testPermission(peer.Permissions, "reboot"), "windowed entry without time")
+	assert.False(t, testPermission(peer.Permissions, "deploy"), "windowed deny entry without time")
+}
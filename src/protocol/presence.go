@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Version of remaphore, announced in heartbeats. Set at build time with
+// -ldflags "-X github.com/aurora-is-near/remaphore/src/protocol.Version=...".
+var Version = "dev"
+
+// Presence is the payload of a heartbeat of a receiver.
+type Presence struct {
+	Destination string        `json:"destination"`
+	Version     string        `json:"version"`
+	Started     time.Time     `json:"started"`
+	ConfigHash  string        `json:"config_hash"`
+	Verbs       []string      `json:"verbs"`
+	Interval    time.Duration `json:"interval"` // Time until the next heartbeat.
+}
+
+// Encode returns the presence as message payload.
+func (presence *Presence) Encode() string {
+	d, err := json.Marshal(presence)
+	if err != nil {
+		panic(err)
+	}
+	return string(d)
+}
+
+// ParsePresence parses a heartbeat payload.
+func ParsePresence(payload string) (*Presence, error) {
+	ret := new(Presence)
+	if err := json.Unmarshal([]byte(payload), ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Hash returns a hash of the config that does not depend on private keys. Nodes
+// with equal hashes run the same configuration.
+func (config *Config) Hash() string {
+	c := *config
+	c.Identities = make(Identities, len(config.Identities))
+	for i, identity := range config.Identities {
+		identity.PrivateKey = nil
+		c.Identities[i] = identity
+	}
+	h := sha256.Sum256([]byte(c.String()))
+	return hex.EncodeToString(h[:8])
+}
@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePresence(t *testing.T) {
+	presence := &Presence{
+		Destination: "net.crypto.us",
+		Version:     Version,
+		Started:     time.Now().UTC(),
+		ConfigHash:  NewConfig().Hash(),
+		Verbs:       []string{"ping", "deploy"},
+		Interval:    time.Minute,
+	}
+	parsed, err := ParsePresence(presence.Encode())
+	if err != nil {
+		t.Fatalf("ParsePresence: %s", err)
+	}
+	assert.Equal(t, presence, parsed)
+	if _, err := ParsePresence("NO_DATA"); err == nil {
+		t.Error("Invalid payload parsed")
+	}
+}
+
+func TestConfig_Hash(t *testing.T) {
+	c := NewConfig()
+	other := *c
+	other.Identities = append(Identities(nil), c.Identities...)
+	other.Identities[0].PrivateKey = NewConfig().Identities[0].PrivateKey
+	assert.Equal(t, c.Hash(), other.Hash(), "private keys must not change the hash")
+	other.Destination = "other"
+	assert.NotEqual(t, c.Hash(), other.Hash())
+	assert.NotNil(t, c.Identities[0].PrivateKey)
+}
@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const replaySweepInterval = time.Minute
+
+// ReplayCache remembers messages for as long as they would pass the time window check
+// and rejects messages that have been seen before. If a filename is given, the
+// entries are persisted so that a restarted receiver remains protected.
+type ReplayCache struct {
+	mutex     sync.Mutex
+	entries   map[string]time.Time
+	lastSweep time.Time
+	filename  string
+	file      *os.File
+}
+
+// NewReplayCache creates a replay cache. filename may be empty for a memory-only cache.
+func NewReplayCache(filename string) (*ReplayCache, error) {
+	rc := &ReplayCache{
+		entries:   make(map[string]time.Time),
+		lastSweep: time.Now(),
+		filename:  filename,
+	}
+	if len(filename) == 0 {
+		return rc, nil
+	}
+	if err := rc.load(); err != nil {
+		return nil, err
+	}
+	if err := rc.compact(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (rc *ReplayCache) load() error {
+	f, err := os.Open(rc.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		until, err := strconv.ParseInt(fields[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		if t := time.Unix(0, until); t.After(now) {
+			rc.entries[fields[0]] = t
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the store with the current entries only. New entries are appended
+// to the rewritten store. If compacting fails, they are appended to the old one.
+func (rc *ReplayCache) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(rc.filename), filepath.Base(rc.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for k, v := range rc.entries {
+		_, _ = fmt.Fprintf(w, "%s %x\n", k, v.UnixNano())
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), rc.filename); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if rc.file != nil {
+		_ = rc.file.Close()
+	}
+	rc.file = tmp
+	return nil
+}
+
+func (rc *ReplayCache) sweep(now time.Time) {
+	if now.Sub(rc.lastSweep) < replaySweepInterval {
+		return
+	}
+	rc.lastSweep = now
+	for k, v := range rc.entries {
+		if !v.After(now) {
+			delete(rc.entries, k)
+		}
+	}
+	if rc.file != nil {
+		if err := rc.compact(); err != nil {
+			log.Printf("Replay store not compacted: %s", err)
+		}
+	}
+}
+
+// Verify records the message until the given time and returns ErrReplay if it has been seen before.
+// The message must have been decoded successfully before.
+func (rc *ReplayCache) Verify(msg *Message, until time.Time) error {
+	if rc == nil {
+		return nil
+	}
+	key := hex.EncodeToString(msg.replayKey())
+	now := time.Now()
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.sweep(now)
+	if t, ok := rc.entries[key]; ok && t.After(now) {
+		return ErrReplay
+	}
+	rc.entries[key] = until
+	if rc.file != nil {
+		if _, err := fmt.Fprintf(rc.file, "%s %x\n", key, until.UnixNano()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the on-disk store, if any.
+func (rc *ReplayCache) Close() error {
+	if rc == nil {
+		return nil
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if rc.file == nil {
+		return nil
+	}
+	err := rc.file.Close()
+	rc.file = nil
+	return err
+}
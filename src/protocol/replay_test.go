@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayCache_Verify(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	d, err := (&Message{Destination: "**", Verb: "ping", Payload: "x"}).EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	filename := filepath.Join(t.TempDir(), "replay")
+	rc, err := NewReplayCache(filename)
+	if err != nil {
+		t.Fatalf("NewReplayCache: %s", err)
+	}
+	msg, err := DecodeMessage(peer2, d)
+	if err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if err := rc.Verify(msg, msg.ValidUntil(peer2)); err != nil {
+		t.Errorf("First message: %s", err)
+	}
+	msg, _ = DecodeMessage(peer2, d)
+	if err := rc.Verify(msg, msg.ValidUntil(peer2)); err != ErrReplay {
+		t.Errorf("Replay not detected: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	rc, err = NewReplayCache(filename)
+	if err != nil {
+		t.Fatalf("NewReplayCache: %s", err)
+	}
+	defer func() { _ = rc.Close() }()
+	if err := rc.Verify(msg, msg.ValidUntil(peer2)); err != ErrReplay {
+		t.Errorf("Replay not detected after restart: %v", err)
+	}
+}
+
+func TestReplayCache_CompactError(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	dir := filepath.Join(t.TempDir(), "store")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("Mkdir: %s", err)
+	}
+	rc, err := NewReplayCache(filepath.Join(dir, "replay"))
+	if err != nil {
+		t.Fatalf("NewReplayCache: %s", err)
+	}
+	defer func() { _ = rc.Close() }()
+	file := rc.file
+	// Compacting fails without the directory, but the store stays open.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("RemoveAll: %s", err)
+	}
+	rc.lastSweep = time.Now().Add(-2 * replaySweepInterval)
+	for i := 0; i < 2; i++ {
+		d, err := (&Message{Destination: "**", Verb: "ping", Payload: "x"}).EncodeMessage(peer1)
+		if err != nil {
+			t.Fatalf("EncodeMessage: %s", err)
+		}
+		msg, err := DecodeMessage(peer2, d)
+		if err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		if err := rc.Verify(msg, msg.ValidUntil(peer2)); err != nil {
+			t.Errorf("Verify: %s", err)
+		}
+	}
+	if rc.file == nil || rc.file != file {
+		t.Error("store closed after failed compaction")
+	}
+}
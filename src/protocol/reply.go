@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status of a reply whose command was not executed or did not complete.
+const (
+	StatusBusy      = "busy"      // The receiver had no capacity to execute the command.
+	StatusTimeout   = "timeout"   // The command was killed after its timeout.
+	StatusCancelled = "cancelled" // The command was cancelled by the requester or the receiver stopped.
+	StatusAck       = "ack"       // The message was delivered. Nothing has been executed yet.
+)
+
+// DefaultOutputLimit is the default maximum of captured output per command. JSON
+// escapes control characters to six bytes and encryption encodes the reply in
+// base64, so the encoded reply can be eight times larger than the output. The
+// default keeps that within the default NATS payload limit of 1MB.
+const DefaultOutputLimit = 96 * 1024
+
+// Reply is the structured payload of a reply to a request.
+type Reply struct {
+	Destination string    `json:"destination"`
+	ExitCode    int       `json:"exit_code"`
+	Stdout      string    `json:"stdout"`
+	Stderr      string    `json:"stderr"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Truncated   bool      `json:"truncated"`
+	Status      string    `json:"status,omitempty"`
+	Seq         int       `json:"seq,omitempty"`     // Sequence number of streamed replies, starting at 1.
+	Partial     bool      `json:"partial,omitempty"` // More replies follow. Set on all but the final streamed reply.
+}
+
+// Encode returns the reply as message payload.
+func (reply *Reply) Encode() string {
+	d, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	return string(d)
+}
+
+// Duration returns the runtime of the command.
+func (reply *Reply) Duration() time.Duration {
+	return reply.End.Sub(reply.Start)
+}
+
+// Output returns stdout followed by stderr.
+func (reply *Reply) Output() string {
+	return reply.Stdout + reply.Stderr
+}
+
+// ParseReply parses a reply payload. Payloads of older versions in the format
+// "exitcode,output" and unstructured payloads are converted.
+func ParseReply(payload string) *Reply {
+	ret := new(Reply)
+	if strings.HasPrefix(payload, "{") && json.Unmarshal([]byte(payload), ret) == nil {
+		return ret
+	}
+	ret = new(Reply)
+	if p := strings.Index(payload, ","); p > 0 {
+		if exitCode, err := strconv.Atoi(payload[:p]); err == nil {
+			ret.ExitCode = exitCode
+			ret.Stdout = payload[p+1:]
+			return ret
+		}
+	}
+	ret.Stdout = payload
+	return ret
+}
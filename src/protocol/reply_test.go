@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReply(t *testing.T) {
+	now := time.Now().UTC()
+	reply := &Reply{
+		Destination: "net.crypto.us",
+		ExitCode:    3,
+		Stdout:      "out\nput",
+		Stderr:      "err",
+		Start:       now,
+		End:         now.Add(time.Second),
+		Truncated:   true,
+	}
+	assert.Equal(t, reply, ParseReply(reply.Encode()))
+	assert.Equal(t, &Reply{ExitCode: 2, Stdout: "legacy,output"}, ParseReply("2,legacy,output"))
+	assert.Equal(t, &Reply{Stdout: "NO_DATA"}, ParseReply("NO_DATA"))
+}
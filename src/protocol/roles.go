@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rolePrefix marks a reference to a role in a permission list, e.g. "@operator".
+const rolePrefix = "@"
+
+// maxRoleDepth limits how deeply roles may refer to other roles.
+const maxRoleDepth = 8
+
+var roleName = regexp.MustCompile(`^[-_a-z0-9]+$`)
+
+// Roles are named lists of permission entries. Permission lists of identities, peers,
+// users and other roles refer to them with "@name".
+type Roles map[string][]string
+
+// IsRoleRef returns true if the permission entry refers to a role.
+func IsRoleRef(entry string) bool {
+	return strings.HasPrefix(entry, rolePrefix)
+}
+
+// ValidRoleName returns an error if name cannot be used as a role name.
+func ValidRoleName(name string) error {
+	if !roleName.MatchString(name) {
+		return fmt.Errorf("bad role name: \"%s\"", name)
+	}
+	return nil
+}
+
+// Expand returns permissions with role references replaced by the entries of the
+// roles. Permissions without role references are returned unchanged.
+func (roles Roles) Expand(permissions []string) ([]string, error) {
+	return roles.expand(permissions, 0)
+}
+
+func (roles Roles) expand(permissions []string, depth int) ([]string, error) {
+	if depth > maxRoleDepth {
+		return nil, fmt.Errorf("roles nested deeper than %d", maxRoleDepth)
+	}
+	refs := false
+	for _, p := range permissions {
+		refs = refs || IsRoleRef(p)
+	}
+	if !refs {
+		return permissions, nil
+	}
+	ret := make([]string, 0, len(permissions))
+	for _, p := range permissions {
+		if !IsRoleRef(p) {
+			ret = append(ret, p)
+			continue
+		}
+		role, ok := roles[p[len(rolePrefix):]]
+		if !ok {
+			return nil, fmt.Errorf("unknown role: \"%s\"", p)
+		}
+		expanded, err := roles.expand(role, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, expanded...)
+	}
+	return ret, nil
+}
+
+// Names returns the sorted names of the roles.
+func (roles Roles) Names() []string {
+	ret := make([]string, 0, len(roles))
+	for name := range roles {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// declaredPermissions returns the permission list as written in the config.
+func declaredPermissions(permissions, declared []string) string {
+	if declared != nil {
+		permissions = declared
+	}
+	return strings.Join(permissions, ", ")
+}
@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoles_Expand(t *testing.T) {
+	roles := Roles{
+		"readonly": {"ping", "status"},
+		"operator": {"@readonly", "deploy.*", "restart@com.crypto.us.*"},
+		"loop":     {"@loop"},
+	}
+	permissions := []string{"ping"}
+	expanded, err := roles.Expand(permissions)
+	assert.NoError(t, err)
+	assert.Equal(t, permissions, expanded)
+	expanded, err = roles.Expand([]string{"@operator", "!deploy.db"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ping", "status", "deploy.*", "restart@com.crypto.us.*", "!deploy.db"}, expanded)
+	if _, err := roles.Expand([]string{"@admin"}); err == nil {
+		t.Error("Unknown role expanded")
+	}
+	if _, err := roles.Expand([]string{"@loop"}); err == nil {
+		t.Error("Recursive role expanded")
+	}
+}
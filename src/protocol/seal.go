@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	ErrNoRecipients  = errors.New("no recipients to encrypt for")
+	ErrNotRecipient  = errors.New("message not encrypted for any local identity")
+	ErrDecrypt       = errors.New("message cannot be decrypted")
+	ErrNotEncrypted  = errors.New("verb requires encrypted message")
+	ErrRecipientKey  = errors.New("recipient key cannot be converted")
+	curve25519P      = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	curve25519PMinus = new(big.Int).Sub(curve25519P, big.NewInt(2))
+)
+
+// sealedPayload is the encrypted form of a payload. The payload is encrypted with a random
+// content key, which is wrapped for every recipient with a key agreed between an ephemeral
+// X25519 key and the recipient's X25519 key derived from its ed25519 key.
+type sealedPayload struct {
+	Ephemeral []byte            `json:"e"`
+	Keys      map[string][]byte `json:"k"`
+	Nonce     []byte            `json:"n"`
+	Data      []byte            `json:"d"`
+}
+
+// x25519PublicKey converts an ed25519 public key to the birationally equivalent X25519 public key.
+func x25519PublicKey(publicKey []byte) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrRecipientKey
+	}
+	// Little endian y coordinate without the sign bit of x.
+	be := make([]byte, len(publicKey))
+	for i, b := range publicKey {
+		be[len(be)-1-i] = b
+	}
+	be[0] &= 0x7f
+	y := new(big.Int).SetBytes(be)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, ErrRecipientKey
+	}
+	// u = (1 + y) / (1 - y)
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, ErrRecipientKey
+	}
+	u := num.Mul(num, den.Exp(den, curve25519PMinus, curve25519P))
+	u.Mod(u, curve25519P)
+	ub := u.FillBytes(make([]byte, curve25519.PointSize))
+	for i, j := 0, len(ub)-1; i < j; i, j = i+1, j-1 {
+		ub[i], ub[j] = ub[j], ub[i]
+	}
+	return ub, nil
+}
+
+// x25519PrivateKey converts an ed25519 private key to the X25519 scalar that belongs to x25519PublicKey.
+func x25519PrivateKey(privateKey []byte) []byte {
+	h := sha512.Sum512(ed25519.PrivateKey(privateKey).Seed())
+	return h[:curve25519.ScalarSize]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrappingKey(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+// seal encrypts payload for recipients. The sender's public key is authenticated as additional data.
+func seal(payload string, sender []byte, recipients []Base58Bytes) (string, error) {
+	if len(recipients) == 0 {
+		return "", ErrNoRecipients
+	}
+	ephemeralPrivate := RandomBytes(curve25519.ScalarSize)
+	ephemeral, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	contentKey := RandomBytes(32)
+	ret := &sealedPayload{
+		Ephemeral: ephemeral,
+		Keys:      make(map[string][]byte, len(recipients)),
+	}
+	for _, r := range recipients {
+		recipient, err := x25519PublicKey(r)
+		if err != nil {
+			return "", err
+		}
+		shared, err := curve25519.X25519(ephemeralPrivate, recipient)
+		if err != nil {
+			return "", err
+		}
+		aead, err := newGCM(wrappingKey(shared, ephemeral, recipient))
+		if err != nil {
+			return "", err
+		}
+		// The wrapping key is unique per message and recipient, a zero nonce is safe.
+		ret.Keys[base58.Encode(r)] = aead.Seal(nil, make([]byte, aead.NonceSize()), contentKey, nil)
+	}
+	aead, err := newGCM(contentKey)
+	if err != nil {
+		return "", err
+	}
+	ret.Nonce = RandomBytes(aead.NonceSize())
+	ret.Data = aead.Seal(nil, ret.Nonce, []byte(payload), sender)
+	d, err := json.Marshal(ret)
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
+// open decrypts a sealed payload with the first local identity it has been encrypted for.
+func open(c *Config, sealed string, sender []byte) (string, error) {
+	s := new(sealedPayload)
+	if err := json.Unmarshal([]byte(sealed), s); err != nil {
+		return "", ErrDecrypt
+	}
+	for _, i := range c.Identities {
+		wrapped, ok := s.Keys[base58.Encode(i.PublicKey)]
+		if !ok || len(i.PrivateKey) != ed25519.PrivateKeySize {
+			continue
+		}
+		recipient, err := x25519PublicKey(i.PublicKey)
+		if err != nil {
+			return "", err
+		}
+		shared, err := curve25519.X25519(x25519PrivateKey(i.PrivateKey), s.Ephemeral)
+		if err != nil {
+			return "", ErrDecrypt
+		}
+		aead, err := newGCM(wrappingKey(shared, s.Ephemeral, recipient))
+		if err != nil {
+			return "", err
+		}
+		contentKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped, nil)
+		if err != nil {
+			return "", ErrDecrypt
+		}
+		if aead, err = newGCM(contentKey); err != nil {
+			return "", ErrDecrypt
+		}
+		if len(s.Nonce) != aead.NonceSize() {
+			return "", ErrDecrypt
+		}
+		payload, err := aead.Open(nil, s.Nonce, s.Data, sender)
+		if err != nil {
+			return "", ErrDecrypt
+		}
+		return string(payload), nil
+	}
+	return "", ErrNotRecipient
+}
+
+// SealedFor returns true if the payload of an encrypted message has been encrypted for publicKey.
+func (msg *Message) SealedFor(publicKey []byte) bool {
+	s := new(sealedPayload)
+	if !msg.Encrypted || json.Unmarshal([]byte(msg.sealed), s) != nil {
+		return false
+	}
+	_, ok := s.Keys[base58.Encode(publicKey)]
+	return ok
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestX25519Keys(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		c := NewConfig()
+		publicKey, err := x25519PublicKey(c.Identities[0].PublicKey)
+		if err != nil {
+			t.Fatalf("x25519PublicKey: %s", err)
+		}
+		expected, err := curve25519.X25519(x25519PrivateKey(c.Identities[0].PrivateKey), curve25519.Basepoint)
+		if err != nil {
+			t.Fatalf("X25519: %s", err)
+		}
+		if !bytes.Equal(publicKey, expected) {
+			t.Errorf("Key %d does not convert", i)
+		}
+	}
+}
+
+func TestMessage_Encrypted(t *testing.T) {
+	peer1 := NewConfig()
+	peer2 := NewConfig()
+	peer3 := NewConfig()
+	peer1.Peers = append(peer1.Peers, *(peer2.Identities[0].Peer(peer2.Destination)))
+	peer2.Peers = append(peer2.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	peer3.Peers = append(peer3.Peers, *(peer1.Identities[0].Peer(peer1.Destination)))
+	msg := &Message{
+		Destination: "**",
+		Verb:        "ping",
+		Payload:     "secret payload",
+		Encrypted:   true,
+	}
+	d, err := msg.EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	if bytes.Contains(d, []byte(msg.Payload)) {
+		t.Error("Payload not encrypted")
+	}
+	if msg2, err := DecodeMessage(peer2, d); err != nil {
+		t.Errorf("Decode: %s", err)
+	} else if msg2.Payload != msg.Payload || !msg2.Encrypted {
+		t.Errorf("Decrypted payload wrong: %s", msg2.Payload)
+	}
+	if _, err := DecodeMessage(peer3, d); err != ErrNotRecipient {
+		t.Errorf("Decode by non-recipient: %v", err)
+	}
+	peer2.EncryptedVerbs = []string{"ping"}
+	d, err = (&Message{Destination: "**", Verb: "ping", Payload: "plain"}).EncodeMessage(peer1)
+	if err != nil {
+		t.Fatalf("EncodeMessage: %s", err)
+	}
+	if _, err := DecodeMessage(peer2, d); err != ErrNotEncrypted {
+		t.Errorf("Unencrypted message accepted: %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package protocol
 
 import (
 	"crypto/sha256"
-	"strings"
 )
 
 const destSeparator = "."
@@ -25,60 +24,18 @@ func sha256Hash(d []byte) []byte {
 	return h.Sum(nil)
 }
 
-func minInt(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
+// subMatch returns true if the segment s matches the segment pattern p.
 func subMatch(s, p string) bool {
-	if s == p {
-		return true
-	}
-	if p == "*" {
-		return true
-	}
-	if n := strings.Index(p, "*"); n > -1 {
-		pre := p[:n]
-		post := p[n+1:]
-		if len(pre) > 0 && pre != s[:len(pre)] {
-			return false
-		}
-		if len(post) > 0 && post != s[len(s)-len(post):] {
-			return false
-		}
-		return true
-	}
-	return false
+	tokens, err := parseTokens(p)
+	return err == nil && matchTokens(s, tokens)
 }
 
-// MatchWildcards returns true if s matches pattern
-// '*' matches between dots may only occur once between dots.
-// '**' matches beyond dots. May only appear at end of pattern.
+// MatchWildcards returns true if the destination s matches pattern. See Pattern for
+// the syntax. Invalid patterns match nothing.
 func MatchWildcards(s, pattern string) bool {
-	var lastMatch int
-	if n := strings.Index(s, "*"); n > -1 {
-		return false
-	}
-	sf := strings.Split(s, destSeparator)
-	pf := strings.Split(pattern, destSeparator)
-	if len(sf) < len(pf) {
-		return false
-	}
-	if len(sf) >= len(pf) {
-		lastMatch = len(pf) - 1
-	}
-	for i := 0; i < minInt(len(sf), len(pf)); i++ {
-		if pf[i] == "**" {
-			return i == lastMatch
-		}
-		if !subMatch(sf[i], pf[i]) {
-			return false
-		}
-	}
-	if len(sf) > len(pf) {
+	p, err := CompilePattern(pattern)
+	if err != nil {
 		return false
 	}
-	return true
+	return p.Match(s)
 }
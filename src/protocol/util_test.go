@@ -54,6 +54,12 @@ func TestSubMatch(t *testing.T) {
 	if subMatch("abcdE", "ab*cde") {
 		t.Error("Match 6.5 succeeded")
 	}
+	if subMatch("a", "abc*") || subMatch("a", "*abc") {
+		t.Error("Match 7 succeeded")
+	}
+	if !subMatch("abcba", "a*b*a") || subMatch("aba", "ab*ba") {
+		t.Error("Match 8 failed")
+	}
 }
 
 func TestMatchWildcards(t *testing.T) {
@@ -72,8 +78,8 @@ func TestMatchWildcards(t *testing.T) {
 	if MatchWildcards("net.opaque.backends.us.relayer", "net.opaque.backends") {
 		t.Error("Match 4 succeeded")
 	}
-	if MatchWildcards("net.opaque.backends.us.relayer", "net.opaque.**.us.relayer") {
-		t.Error("Match 5 succeeded")
+	if !MatchWildcards("net.opaque.backends.us.relayer", "net.opaque.**.us.relayer") {
+		t.Error("Match 5 failed")
 	}
 	if !MatchWildcards("net.opaque.us", "net.opaque.**") {
 		t.Error("Match 6 failed")
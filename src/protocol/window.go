@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// weekdays are the names of the days in weekly windows, starting with Sunday like time.Weekday.
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is a time window that windowed permission entries are restricted to. It is
+// either weekly, "days start-end [zone]" like "mon-fri 22:00-02:00 Europe/Berlin", or
+// an interval "from/until" of RFC3339 times.
+type Window struct {
+	spec       string
+	days       uint8         // Bit per weekday of a weekly window.
+	start, end time.Duration // Offsets from midnight of a weekly window.
+	location   *time.Location
+	from       time.Time // Start of an interval window.
+	until      time.Time // End of an interval window, exclusive.
+}
+
+// ParseWindow parses a window specification.
+func ParseWindow(spec string) (*Window, error) {
+	spec = strings.Join(strings.Fields(spec), " ")
+	ret := &Window{spec: spec}
+	if p := strings.Index(spec, "/"); p > 0 && !strings.Contains(spec, " ") {
+		var err1, err2 error
+		ret.from, err1 = time.Parse(time.RFC3339, spec[:p])
+		ret.until, err2 = time.Parse(time.RFC3339, spec[p+1:])
+		if err1 != nil || err2 != nil || !ret.until.After(ret.from) {
+			return nil, fmt.Errorf("bad window: \"%s\"", spec)
+		}
+		return ret, nil
+	}
+	f := strings.Split(spec, " ")
+	if len(f) < 2 || len(f) > 3 {
+		return nil, fmt.Errorf("bad window: \"%s\"", spec)
+	}
+	var err error
+	if ret.days, err = parseDays(f[0]); err != nil {
+		return nil, err
+	}
+	hours := strings.Split(f[1], "-")
+	if len(hours) != 2 {
+		return nil, fmt.Errorf("bad window hours: \"%s\"", f[1])
+	}
+	if ret.start, err = parseTimeOfDay(hours[0]); err != nil {
+		return nil, err
+	}
+	if ret.end, err = parseTimeOfDay(hours[1]); err != nil {
+		return nil, err
+	}
+	if ret.start == ret.end {
+		return nil, fmt.Errorf("empty window hours: \"%s\"", f[1])
+	}
+	ret.location = time.UTC
+	if len(f) == 3 {
+		if ret.location, err = time.LoadLocation(f[2]); err != nil {
+			return nil, fmt.Errorf("bad window zone: \"%s\"", f[2])
+		}
+	}
+	return ret, nil
+}
+
+// parseDays parses "*" or a comma-separated list of days and day ranges like "mon-fri,sun".
+func parseDays(s string) (uint8, error) {
+	if s == "*" {
+		return 0x7f, nil
+	}
+	var ret uint8
+	for _, d := range strings.Split(strings.ToLower(s), ",") {
+		r := strings.Split(d, "-")
+		if len(r) > 2 {
+			return 0, fmt.Errorf("bad window days: \"%s\"", s)
+		}
+		first, last := weekday(r[0]), weekday(r[len(r)-1])
+		if first < 0 || last < 0 {
+			return 0, fmt.Errorf("bad window days: \"%s\"", s)
+		}
+		for i := first; ; i = (i + 1) % 7 {
+			ret |= 1 << i
+			if i == last {
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+func weekday(s string) int {
+	for i, d := range weekdays {
+		if s == d {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseTimeOfDay parses "HH:MM", up to "24:00".
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time of day: \"%s\"", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (w *Window) String() string {
+	return w.spec
+}
+
+// Contains returns true if t lies within the window. Weekly windows that end before
+// they start continue on the next day.
+func (w *Window) Contains(t time.Time) bool {
+	if w.location == nil {
+		return !t.Before(w.from) && t.Before(w.until)
+	}
+	t = t.In(w.location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.location)
+	offset := t.Sub(midnight)
+	today := w.days&(1<<uint(t.Weekday())) != 0
+	if w.start < w.end {
+		return today && offset >= w.start && offset < w.end
+	}
+	yesterday := w.days&(1<<uint((t.Weekday()+6)%7)) != 0
+	return today && offset >= w.start || yesterday && offset < w.end
+}
+
+// Windows are named time windows. A name with several windows covers all of them.
+type Windows map[string][]*Window
+
+// Contains returns true if all times lie within a window of the name. It returns
+// false for unknown names and if no times are given.
+func (windows Windows) Contains(name string, times ...time.Time) bool {
+	if len(times) == 0 {
+		return false
+	}
+	for _, t := range times {
+		in := false
+		for _, w := range windows[name] {
+			if w.Contains(t) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	return true
+}
+
+// Names returns the sorted names of the windows.
+func (windows Windows) Names() []string {
+	ret := make([]string, 0, len(windows))
+	for name := range windows {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
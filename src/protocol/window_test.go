@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindow_Contains(t *testing.T) {
+	at := func(s string) time.Time {
+		ret, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	for _, c := range []struct {
+		spec, time string
+		contains   bool
+	}{
+		{"sat,sun 02:00-04:00", "2026-10-17T02:00:00Z", true}, // Saturday
+		{"sat,sun 02:00-04:00", "2026-10-17T04:00:00Z", false},
+		{"sat,sun 02:00-04:00", "2026-10-16T03:00:00Z", false},
+		{"mon-fri 22:00-02:00", "2026-10-16T23:00:00Z", true},
+		{"mon-fri 22:00-02:00", "2026-10-17T01:59:00Z", true}, // Continues from Friday.
+		{"mon-fri 22:00-02:00", "2026-10-18T01:00:00Z", false},
+		{"fri-mon 00:00-24:00", "2026-10-19T12:00:00Z", true},
+		{"fri-mon 00:00-24:00", "2026-10-20T12:00:00Z", false},
+		{"* 02:00-03:00 Europe/Berlin", "2026-10-17T00:30:00Z", true},
+		{"* 02:00-03:00 Europe/Berlin", "2026-10-17T02:30:00Z", false},
+		{"2026-12-20T00:00:00Z/2027-01-05T00:00:00Z", "2026-12-24T18:00:00Z", true},
+		{"2026-12-20T00:00:00Z/2027-01-05T00:00:00Z", "2027-01-05T00:00:00Z", false},
+	} {
+		w, err := ParseWindow(c.spec)
+		if err != nil {
+			t.Fatalf("ParseWindow %s: %s", c.spec, err)
+		}
+		if w.Contains(at(c.time)) != c.contains {
+			t.Errorf("%s contains %s: %v", c.spec, c.time, !c.contains)
+		}
+	}
+	for _, spec := range []string{"", "sat", "sat 02:00", "funday 02:00-03:00", "sat 2:00-03:00", "sat 02:00-02:00",
+		"sat 02:00-25:00", "* 02:00-03:00 Nowhere/City", "2027-01-05T00:00:00Z/2026-12-20T00:00:00Z"} {
+		_, err := ParseWindow(spec)
+		assert.Error(t, err, spec)
+	}
+}
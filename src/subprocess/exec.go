@@ -1,38 +1,268 @@
 package subprocess
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aurora-is-near/remaphore/src/protocol"
 	"github.com/btcsuite/btcutil/base58"
 )
 
-func Exec(ctx context.Context, config *protocol.Config, args []string, msg *protocol.Message) (out string, err error) {
+// Exec runs the command of handler for msg with the handler's settings.
+func Exec(ctx context.Context, config *protocol.Config, handler *protocol.Handler, msg *protocol.Message) (reply *protocol.Reply, err error) {
+	return ExecStream(ctx, config, handler, msg, nil)
+}
+
+// ExecStream is Exec that passes output to stream in partial replies while the
+// command runs, if stream is not nil. The returned final reply then only contains
+// output that has not been streamed yet.
+func ExecStream(ctx context.Context, config *protocol.Config, handler *protocol.Handler, msg *protocol.Message, stream StreamFunc) (reply *protocol.Reply, err error) {
 	var destMatch string
 	pubkey := base58.Encode(msg.SenderPublicKey)
-	args = append(args, msg.Verb, msg.Payload)
+	args := make([]string, 0, len(handler.Command)+2)
+	args = append(args, handler.Command...)
+	args = append(args, msg.Verb)
+	if handler.Delivery == "" || handler.Delivery == protocol.DeliveryArgv {
+		args = append(args, msg.Payload)
+	}
+	if handler.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handler.Timeout)
+		defer cancel()
+	}
 	destMatches := protocol.MatchWildcards(config.Destination, msg.Destination)
 	if destMatches {
 		destMatch = config.Destination
 	}
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Env = []string{
 		fmt.Sprintf("%s=%s", "REMAPHORE_SENDER", pubkey),
 		fmt.Sprintf("%s=%s", "REMAPHORE_VERB", msg.Verb),
 		fmt.Sprintf("%s=%d", "REMAPHORE_TIME", msg.SendTimeNano/int64(time.Second)),
 		fmt.Sprintf("%s=%x", "REMAPHORE_UUID", msg.UUID),
-		fmt.Sprintf("%s=%s", "REMAPHORE_MSG", msg.Payload),
 	}
 	if destMatches {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", "REMAPHORE_DESTMATCH", destMatch))
 	}
-	op1, err := cmd.CombinedOutput()
-	exitCode := cmd.ProcessState.ExitCode()
-	log.Printf("Exec (%d): '%s'", exitCode, strings.Join(args, " "))
-	return fmt.Sprintf("%d,%s", exitCode, string(op1)), err
+	cmd.Dir = handler.Dir
+	if err := setUser(cmd, handler); err != nil {
+		return &protocol.Reply{Destination: config.Destination, ExitCode: -1, Stderr: err.Error()}, err
+	}
+	if err := setLimits(cmd, handler); err != nil {
+		return &protocol.Reply{Destination: config.Destination, ExitCode: -1, Stderr: err.Error()}, err
+	}
+	switch handler.Delivery {
+	case protocol.DeliveryStdin:
+		cmd.Stdin = strings.NewReader(msg.Payload)
+	case protocol.DeliveryFile:
+		filename, err := writeMessageFile(cmd, msg)
+		if err != nil {
+			return &protocol.Reply{Destination: config.Destination, ExitCode: -1, Stderr: err.Error()}, err
+		}
+		defer func() { _ = os.Remove(filename) }()
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", "REMAPHORE_MSG_FILE", filename))
+	default:
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", "REMAPHORE_MSG", msg.Payload))
+	}
+	if ctx.Err() != nil {
+		now := time.Now()
+		return &protocol.Reply{Destination: config.Destination, ExitCode: -1, Start: now, End: now, Status: protocol.StatusCancelled}, ctx.Err()
+	}
+	limit := handler.OutputLimit
+	if limit <= 0 {
+		limit = protocol.DefaultOutputLimit
+	}
+	out := &capture{remaining: limit}
+	cmd.Stdout = out.writer(&out.stdout)
+	cmd.Stderr = out.writer(&out.stderr)
+	setProcessGroup(cmd)
+	reply = &protocol.Reply{
+		Destination: config.Destination,
+		Start:       time.Now(),
+	}
+	var streamer *streamer
+	if stream != nil {
+		streamer = newStreamer(out, reply, stream)
+	}
+	err = run(ctx, cmd)
+	reply.End = time.Now()
+	reply.ExitCode = cmd.ProcessState.ExitCode()
+	if streamer != nil {
+		reply.Seq = streamer.stop()
+	}
+	reply.Stdout, reply.Stderr = out.take()
+	reply.Truncated = out.truncated
+	if err != nil && cmd.ProcessState == nil {
+		reply.Stderr += err.Error()
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		reply.Status = protocol.StatusTimeout
+	case context.Canceled:
+		reply.Status = protocol.StatusCancelled
+	}
+	log.Printf("Exec (%d): '%s'", reply.ExitCode, strings.Join(args, " "))
+	return reply, err
+}
+
+// waitDelay is how long output is read after the command exited. Processes it left
+// behind may keep its output open, which would otherwise block Wait forever.
+var waitDelay = 5 * time.Second
+
+// run runs cmd and kills its process group when ctx is done. Input and output are
+// copied through pipes owned by run, which are closed waitDelay after cmd exited.
+func run(ctx context.Context, cmd *exec.Cmd) error {
+	var copying sync.WaitGroup
+	var parent, child []*os.File
+	for _, w := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		if *w == nil {
+			continue
+		}
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			closeFiles(parent)
+			closeFiles(child)
+			return err
+		}
+		parent, child = append(parent, pr), append(child, pw)
+		copying.Add(1)
+		go func(dst io.Writer) {
+			defer copying.Done()
+			_, _ = io.Copy(dst, pr)
+		}(*w)
+		*w = pw
+	}
+	if cmd.Stdin != nil {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			closeFiles(parent)
+			closeFiles(child)
+			return err
+		}
+		parent, child = append(parent, pw), append(child, pr)
+		go func(src io.Reader) {
+			_, _ = io.Copy(pw, src)
+			_ = pw.Close()
+		}(cmd.Stdin)
+		cmd.Stdin = pr
+	}
+	err := cmd.Start()
+	closeFiles(child)
+	if err != nil {
+		closeFiles(parent)
+		copying.Wait()
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	copied := make(chan struct{})
+	go func() {
+		copying.Wait()
+		close(copied)
+	}()
+	select {
+	case <-copied:
+	case <-time.After(waitDelay):
+	}
+	closeFiles(parent)
+	<-copied
+	return err
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// capture collects the output of a command up to a combined limit. Output
+// beyond the limit is discarded.
+type capture struct {
+	mutex     sync.Mutex
+	remaining int
+	truncated bool
+	stdout    bytes.Buffer
+	stderr    bytes.Buffer
+	notify    chan struct{} // Signalled when streamChunk bytes are pending, if set.
+}
+
+type captureWriter struct {
+	capture *capture
+	buf     *bytes.Buffer
+}
+
+func (out *capture) writer(buf *bytes.Buffer) io.Writer {
+	return &captureWriter{capture: out, buf: buf}
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.capture.mutex.Lock()
+	defer w.capture.mutex.Unlock()
+	d := p
+	if len(d) > w.capture.remaining {
+		d = d[:w.capture.remaining]
+		w.capture.truncated = true
+	}
+	w.capture.remaining -= len(d)
+	w.buf.Write(d)
+	if w.capture.notify != nil && w.capture.stdout.Len()+w.capture.stderr.Len() >= streamChunk {
+		select {
+		case w.capture.notify <- struct{}{}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// take returns and removes the output collected so far.
+func (out *capture) take() (stdout, stderr string) {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	stdout, stderr = out.stdout.String(), out.stderr.String()
+	out.stdout.Reset()
+	out.stderr.Reset()
+	return stdout, stderr
+}
+
+// writeMessageFile writes msg as JSON to a temporary file that only the user of cmd can read.
+func writeMessageFile(cmd *exec.Cmd, msg *protocol.Message) (filename string, err error) {
+	d, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile("", "remaphore-msg-*.json")
+	if err != nil {
+		return "", err
+	}
+	filename = f.Name()
+	_, err = f.Write(d)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = chownUser(cmd, filename)
+	}
+	if err != nil {
+		_ = os.Remove(filename)
+		return "", err
+	}
+	return filename, nil
 }
@@ -0,0 +1,119 @@
+package subprocess
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+func TestExec_DestMatch(t *testing.T) {
+	config := protocol.NewConfig()
+	config.Destination = "web1"
+	handlers := protocol.Handlers{{Verb: "deploy", Destination: "web*", Command: []string{"/bin/sh", "-c", "echo -n $REMAPHORE_DESTMATCH"}}}
+	msg := &protocol.Message{Verb: "deploy", Destination: "{web,db}[1-9]"}
+	handler := handlers.Find(config, msg)
+	if handler == nil {
+		t.Fatal("handler does not match")
+	}
+	reply, err := Exec(context.Background(), config, handler, msg)
+	if err != nil {
+		t.Fatalf("Exec: %s", err)
+	}
+	if reply.ExitCode != 0 || reply.Stdout != "web1" {
+		t.Errorf("reply: %d %q", reply.ExitCode, reply.Stdout)
+	}
+}
+
+func TestExec_Delivery(t *testing.T) {
+	msg := &protocol.Message{Verb: "deploy", Payload: "v1.2 'quoted'\n"}
+	for _, c := range []struct {
+		delivery string
+		script   string
+	}{
+		{protocol.DeliveryArgv, `printf %s "$1"`},
+		{protocol.DeliveryStdin, "cat"},
+		{protocol.DeliveryFile, `cat "$REMAPHORE_MSG_FILE"`},
+	} {
+		handler := &protocol.Handler{Delivery: c.delivery, Command: []string{"/bin/sh", "-c", c.script}}
+		reply, err := Exec(context.Background(), protocol.NewConfig(), handler, msg)
+		if err != nil {
+			t.Fatalf("%s: %s", c.delivery, err)
+		}
+		payload := reply.Stdout
+		if c.delivery == protocol.DeliveryFile {
+			delivered := new(protocol.Message)
+			if err := json.Unmarshal([]byte(reply.Stdout), delivered); err != nil {
+				t.Fatalf("%s: %s", c.delivery, err)
+			}
+			payload = delivered.Payload
+		}
+		if payload != msg.Payload {
+			t.Errorf("%s: %q", c.delivery, payload)
+		}
+	}
+}
+
+func TestExec_Timeout(t *testing.T) {
+	handler := &protocol.Handler{Timeout: 100 * time.Millisecond, Command: []string{"/bin/sh", "-c", "sleep 10"}}
+	start := time.Now()
+	reply, _ := Exec(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Took %s", d)
+	}
+	if reply.ExitCode != -1 || reply.Status != protocol.StatusTimeout {
+		t.Errorf("reply: %d %s", reply.ExitCode, reply.Status)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reply, _ = Exec(ctx, protocol.NewConfig(), &protocol.Handler{Command: []string{"/bin/true"}}, &protocol.Message{Verb: "test"})
+	if reply.Status != protocol.StatusCancelled {
+		t.Errorf("status of cancelled: %s", reply.Status)
+	}
+}
+
+func TestExec_OutputLimit(t *testing.T) {
+	handler := &protocol.Handler{OutputLimit: 10, Command: []string{"/bin/sh", "-c", "printf 01234; printf abc >&2; printf 56789xyz"}}
+	reply, err := Exec(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"})
+	if err != nil {
+		t.Fatalf("Exec: %s", err)
+	}
+	if len(reply.Stdout)+len(reply.Stderr) != 10 || !strings.HasPrefix(reply.Stdout, "01234") || !reply.Truncated {
+		t.Errorf("reply: %q %q %v", reply.Stdout, reply.Stderr, reply.Truncated)
+	}
+	handler.Command = []string{"/bin/sh", "-c", "printf 0123456789"}
+	if reply, _ = Exec(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"}); reply.Truncated {
+		t.Error("output within limit truncated")
+	}
+}
+
+func TestExecStream(t *testing.T) {
+	var mutex sync.Mutex
+	var partial []*protocol.Reply
+	stream := func(reply *protocol.Reply) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		partial = append(partial, reply)
+	}
+	handler := &protocol.Handler{Command: []string{"/bin/sh", "-c", "printf first; sleep 1; printf second"}}
+	reply, err := ExecStream(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"}, stream)
+	if err != nil {
+		t.Fatalf("ExecStream: %s", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(partial) == 0 || partial[0].Stdout != "first" {
+		t.Fatalf("partial replies: %v", partial)
+	}
+	out := ""
+	for _, p := range partial {
+		out += p.Stdout
+	}
+	if out+reply.Stdout != "firstsecond" {
+		t.Errorf("output: %q + %q", out, reply.Stdout)
+	}
+}
@@ -0,0 +1,106 @@
+package subprocess
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// Umask, rlimits and no_new_privs cannot be set for a child by os/exec. Commands
+// that need them are started through the running binary with helperArg, which
+// applies the settings to itself and then replaces itself with the command.
+const helperArg = "-remaphore-exec-helper"
+
+const prSetNoNewPrivs = 38 // PR_SET_NO_NEW_PRIVS
+
+// ExecHelper runs the helper and does not return if the process has been started
+// as one. Programs that execute handlers must call it at the start of main.
+func ExecHelper() {
+	if len(os.Args) > 1 && os.Args[1] == helperArg {
+		err := runHelper(os.Args[2:])
+		_, _ = fmt.Fprintf(os.Stderr, "exec helper: %s\n", err)
+		os.Exit(126)
+	}
+}
+
+// setLimits makes cmd start through the helper if handler has settings that
+// must be applied before exec.
+func setLimits(cmd *exec.Cmd, handler *protocol.Handler) error {
+	var opts []string
+	if len(handler.Umask) > 0 {
+		opts = append(opts, "umask="+handler.Umask)
+	}
+	if handler.RlimitCPU > 0 {
+		opts = append(opts, fmt.Sprintf("cpu=%d", uint64(handler.RlimitCPU.Seconds())))
+	}
+	if handler.RlimitMemory > 0 {
+		opts = append(opts, fmt.Sprintf("as=%d", handler.RlimitMemory))
+	}
+	if handler.RlimitNofile > 0 {
+		opts = append(opts, fmt.Sprintf("nofile=%d", handler.RlimitNofile))
+	}
+	if handler.NoNewPrivs {
+		opts = append(opts, "nnp=1")
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := append([]string{self, helperArg}, opts...)
+	args = append(args, "--", cmd.Path)
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = self
+	return nil
+}
+
+// runHelper applies the settings in args up to "--" and executes the command
+// following it. It only returns on error.
+func runHelper(args []string) error {
+	for len(args) > 0 && args[0] != "--" {
+		p := strings.Index(args[0], "=")
+		if p <= 0 {
+			return fmt.Errorf("bad option: %s", args[0])
+		}
+		key := args[0][:p]
+		base := 10
+		if key == "umask" {
+			base = 8
+		}
+		value, err := strconv.ParseUint(args[0][p+1:], base, 64)
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "umask":
+			syscall.Umask(int(value))
+		case "cpu":
+			err = syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: value, Max: value})
+		case "as":
+			err = syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: value, Max: value})
+		case "nofile":
+			err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: value, Max: value})
+		case "nnp":
+			if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+				err = errno
+			}
+		default:
+			err = fmt.Errorf("unknown option: %s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("no command")
+	}
+	return syscall.Exec(args[1], args[1:], os.Environ())
+}
@@ -0,0 +1,63 @@
+package subprocess
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+func TestMain(m *testing.M) {
+	ExecHelper()
+	os.Exit(m.Run())
+}
+
+// shell runs script with the settings of handler and returns its output.
+func shell(t *testing.T, handler *protocol.Handler, script string) string {
+	handler.Command = []string{"/bin/sh", "-c", script}
+	reply, err := Exec(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"})
+	if err != nil {
+		t.Fatalf("Exec: %s: %s", err, reply.Stderr)
+	}
+	if reply.ExitCode != 0 {
+		t.Fatalf("Exit code %d: %s", reply.ExitCode, reply.Stderr)
+	}
+	return strings.TrimSpace(reply.Stdout)
+}
+
+func TestExec_Limits(t *testing.T) {
+	for _, c := range []struct {
+		handler  protocol.Handler
+		script   string
+		expected string
+	}{
+		{protocol.Handler{Umask: "027"}, "umask", "0027"},
+		{protocol.Handler{RlimitCPU: 7 * time.Second}, "ulimit -t", "7"},
+		{protocol.Handler{RlimitMemory: 1 << 30}, "ulimit -v", "1048576"},
+		{protocol.Handler{RlimitNofile: 64}, "ulimit -n", "64"},
+		{protocol.Handler{NoNewPrivs: true}, "grep NoNewPrivs /proc/self/status | tr -d ' \t'", "NoNewPrivs:1"},
+		{protocol.Handler{}, "grep NoNewPrivs /proc/self/status | tr -d ' \t'", "NoNewPrivs:0"},
+	} {
+		if out := shell(t, &c.handler, c.script); out != c.expected {
+			t.Errorf("%s: %q, expected %q", c.script, out, c.expected)
+		}
+	}
+}
+
+func TestExec_Groups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting groups requires root")
+	}
+	for _, gid := range []string{"1", "2", "3"} {
+		if _, err := user.LookupGroupId(gid); err != nil {
+			t.Skipf("group %s: %s", gid, err)
+		}
+	}
+	if out := shell(t, &protocol.Handler{Group: "1", Groups: []string{"2", "3"}}, "id -g; id -G"); out != "1\n1 2 3" {
+		t.Errorf("Groups: %q", out)
+	}
+}
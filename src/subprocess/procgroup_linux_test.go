@@ -0,0 +1,59 @@
+package subprocess
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// running returns true if the process exists and is not a zombie.
+func running(pid int) bool {
+	d, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	f := strings.Fields(string(d[strings.LastIndexByte(string(d), ')')+1:]))
+	return len(f) > 0 && f[0] != "Z"
+}
+
+func backgroundPid(t *testing.T, reply *protocol.Reply) int {
+	pid, err := strconv.Atoi(strings.TrimSpace(reply.Stdout))
+	if err != nil {
+		t.Fatalf("pid: %q", reply.Stdout)
+	}
+	return pid
+}
+
+func TestExec_KillProcessGroup(t *testing.T) {
+	handler := &protocol.Handler{Timeout: 200 * time.Millisecond, Command: []string{"/bin/sh", "-c", "sleep 30 & echo $!; wait"}}
+	reply, _ := Exec(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"})
+	pid := backgroundPid(t, reply)
+	for i := 0; i < 100 && running(pid); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running(pid) {
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+		t.Error("background process survived timeout")
+	}
+}
+
+func TestExec_WaitDelay(t *testing.T) {
+	defer func(d time.Duration) { waitDelay = d }(waitDelay)
+	waitDelay = 200 * time.Millisecond
+	handler := &protocol.Handler{Command: []string{"/bin/sh", "-c", "sleep 30 & echo $!"}}
+	start := time.Now()
+	reply, _ := Exec(context.Background(), protocol.NewConfig(), handler, &protocol.Message{Verb: "test"})
+	_ = syscall.Kill(backgroundPid(t, reply), syscall.SIGKILL)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Took %s", d)
+	}
+	if reply.ExitCode != 0 {
+		t.Errorf("exit code %d", reply.ExitCode)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package subprocess
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is only supported on linux.
+func setProcessGroup(cmd *exec.Cmd) {
+	_ = cmd
+}
+
+// killProcessGroup kills only cmd on this platform.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	_ = cmd.Process.Kill()
+}
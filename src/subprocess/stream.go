@@ -0,0 +1,77 @@
+package subprocess
+
+import (
+	"time"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+const (
+	streamInterval = time.Second / 2 // Maximum delay of streamed output.
+	streamChunk    = 16 * 1024       // Output is sent early once this many bytes are pending.
+)
+
+// StreamFunc receives partial replies of a running command.
+type StreamFunc func(reply *protocol.Reply)
+
+// streamer sends the output collected by a capture in partial replies.
+type streamer struct {
+	out   *capture
+	reply *protocol.Reply
+	send  StreamFunc
+	seq   int
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+func newStreamer(out *capture, reply *protocol.Reply, send StreamFunc) *streamer {
+	s := &streamer{
+		out:   out,
+		reply: reply,
+		send:  send,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	out.notify = make(chan struct{}, 1)
+	go s.run()
+	return s
+}
+
+func (s *streamer) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		case <-s.out.notify:
+		}
+		s.flush()
+	}
+}
+
+func (s *streamer) flush() {
+	stdout, stderr := s.out.take()
+	if len(stdout) == 0 && len(stderr) == 0 {
+		return
+	}
+	s.seq++
+	s.send(&protocol.Reply{
+		Destination: s.reply.Destination,
+		Stdout:      stdout,
+		Stderr:      stderr,
+		Start:       s.reply.Start,
+		End:         time.Now(),
+		Seq:         s.seq,
+		Partial:     true,
+	})
+}
+
+// stop stops streaming and returns the sequence number of the final reply.
+func (s *streamer) stop() int {
+	close(s.quit)
+	<-s.done
+	return s.seq + 1
+}
@@ -0,0 +1,98 @@
+package subprocess
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// lookupUser looks up a user by name or uid.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return user.LookupId(name)
+	}
+	return u, nil
+}
+
+// lookupGroup returns the gid of a group given by name or gid.
+func lookupGroup(name string) (uint32, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if g, err = user.LookupGroupId(name); err != nil {
+			return 0, err
+		}
+	}
+	return parseID(g.Gid)
+}
+
+func parseID(s string) (uint32, error) {
+	v, err := strconv.ParseUint(s, 10, 32)
+	return uint32(v), err
+}
+
+// setUser makes cmd run as the user, group and supplementary groups of handler.
+// Without a user, the current user is kept and only the groups are changed.
+func setUser(cmd *exec.Cmd, handler *protocol.Handler) error {
+	if len(handler.User) == 0 && len(handler.Group) == 0 && len(handler.Groups) == 0 {
+		return nil
+	}
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if len(handler.User) > 0 {
+		u, err := lookupUser(handler.User)
+		if err != nil {
+			return err
+		}
+		if credential.Uid, err = parseID(u.Uid); err != nil {
+			return err
+		}
+		if credential.Gid, err = parseID(u.Gid); err != nil {
+			return err
+		}
+		if len(handler.Groups) == 0 {
+			groups, err := u.GroupIds()
+			if err != nil {
+				return err
+			}
+			for _, g := range groups {
+				gid, err := parseID(g)
+				if err != nil {
+					return err
+				}
+				credential.Groups = append(credential.Groups, gid)
+			}
+		}
+		cmd.Env = append(cmd.Env, "HOME="+u.HomeDir, "USER="+u.Username)
+	}
+	if len(handler.Group) > 0 {
+		gid, err := lookupGroup(handler.Group)
+		if err != nil {
+			return err
+		}
+		credential.Gid = gid
+	}
+	for _, g := range handler.Groups {
+		gid, err := lookupGroup(g)
+		if err != nil {
+			return err
+		}
+		credential.Groups = append(credential.Groups, gid)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Credential = credential
+	return nil
+}
+
+// chownUser gives the file to the user cmd runs as, if set.
+func chownUser(cmd *exec.Cmd, filename string) error {
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Credential == nil {
+		return nil
+	}
+	return os.Chown(filename, int(cmd.SysProcAttr.Credential.Uid), int(cmd.SysProcAttr.Credential.Gid))
+}
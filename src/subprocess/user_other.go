@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package subprocess
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/aurora-is-near/remaphore/src/protocol"
+)
+
+// setUser is only supported on linux.
+func setUser(cmd *exec.Cmd, handler *protocol.Handler) error {
+	_ = cmd
+	if len(handler.User) == 0 && len(handler.Group) == 0 && len(handler.Groups) == 0 {
+		return nil
+	}
+	return errors.New("running commands as other user not supported on this platform")
+}
+
+// ExecHelper does nothing, the helper is only used on linux.
+func ExecHelper() {}
+
+// setLimits is only supported on linux.
+func setLimits(cmd *exec.Cmd, handler *protocol.Handler) error {
+	_ = cmd
+	if len(handler.Umask) > 0 || handler.RlimitCPU > 0 || handler.RlimitMemory > 0 || handler.RlimitNofile > 0 || handler.NoNewPrivs {
+		return errors.New("umask, rlimits and no_new_privs not supported on this platform")
+	}
+	return nil
+}
+
+func chownUser(cmd *exec.Cmd, filename string) error {
+	_, _ = cmd, filename
+	return nil
+}